@@ -0,0 +1,224 @@
+// Package admin serves a local http api for inspecting and closing the
+// sessions of the servers of a process.
+//
+//	GET    /sessions       list the sessions of every server
+//	GET    /sessions/{id}  show one session
+//	DELETE /sessions/{id}  close a session
+//
+// Every request must carry the token in an "Authorization: Bearer" header.
+package admin
+
+import (
+	"commonweb2/server"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Source lists and closes the sessions of one server
+type Source interface {
+	Sessions() []server.SessionInfo
+	Session(id string) (server.SessionInfo, bool)
+	CloseSession(id string) bool
+}
+
+// a session in the list
+type sessionSummary struct {
+	Tunnel     string  `json:"tunnel"`
+	Id         string  `json:"id"`
+	UpAddr     string  `json:"up_addr"`
+	DownAddr   string  `json:"down_addr"`
+	AgeSeconds float64 `json:"age_seconds"`
+	State      string  `json:"state"`
+	Paired     bool    `json:"paired"`
+	BytesUp    uint64  `json:"bytes_up"`
+	BytesDown  uint64  `json:"bytes_down"`
+}
+
+// a session shown on its own
+type sessionDetail struct {
+	sessionSummary
+	Created     time.Time `json:"created"`
+	Destination string    `json:"destination"`
+	Remote      string    `json:"remote"`
+	Network     string    `json:"network"`
+	Mux         bool      `json:"mux"`
+	Resume      bool      `json:"resume"`
+	Upload      string    `json:"upload"`
+	Download    string    `json:"download"`
+}
+
+func summarize(tunnel string, info server.SessionInfo) sessionSummary {
+	return sessionSummary{
+		Tunnel:     tunnel,
+		Id:         info.Id,
+		UpAddr:     info.UpAddr,
+		DownAddr:   info.DownAddr,
+		AgeSeconds: time.Since(info.Created).Seconds(),
+		State:      info.State,
+		Paired:     info.Paired,
+		BytesUp:    info.BytesUp,
+		BytesDown:  info.BytesDown,
+	}
+}
+
+type handler struct {
+	token   string
+	sources func() map[string]Source // servers by tunnel name
+}
+
+// Handler serves the api for the servers returned by sources, by tunnel
+// name. Requests without the token are refused.
+func Handler(token string, sources func() map[string]Source) http.Handler {
+	return &handler{
+		token:   token,
+		sources: sources,
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	if path == "/sessions" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		h.list(w)
+		return
+	}
+
+	id, ok := strings.CutPrefix(path, "/sessions/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.show(w, id)
+	case http.MethodDelete:
+		h.close(w, id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// the names of the tunnels of sources, sorted
+func tunnelNames(sources map[string]Source) []string {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *handler) list(w http.ResponseWriter) {
+	sources := h.sources()
+
+	list := []sessionSummary{}
+	for _, name := range tunnelNames(sources) {
+		for _, info := range sources[name].Sessions() {
+			list = append(list, summarize(name, info))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *handler) show(w http.ResponseWriter, id string) {
+	sources := h.sources()
+
+	for _, name := range tunnelNames(sources) {
+		info, ok := sources[name].Session(id)
+		if !ok {
+			continue
+		}
+
+		writeJSON(w, http.StatusOK, sessionDetail{
+			sessionSummary: summarize(name, info),
+			Created:        info.Created,
+			Destination:    info.Destination,
+			Remote:         info.Remote,
+			Network:        info.Network,
+			Mux:            info.Mux,
+			Resume:         info.Resume,
+			Upload:         info.Upload,
+			Download:       info.Download,
+		})
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "session not found")
+}
+
+func (h *handler) close(w http.ResponseWriter, id string) {
+	sources := h.sources()
+
+	closed := false
+	for _, name := range tunnelNames(sources) {
+		if sources[name].CloseSession(id) {
+			slog.Info("session closed by admin", "tunnel", name, "sessionId", id)
+			closed = true
+		}
+	}
+
+	if !closed {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// Listen listens on addr, which is "unix:" followed by the path of a unix
+// socket, or a loopback address and port
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// a socket left by a previous process
+		fi, err := os.Lstat(path)
+		if err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("admin: %w", err)
+	}
+
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin: %s is not a loopback address or unix socket", addr)
+	}
+
+	return net.Listen("tcp", addr)
+}
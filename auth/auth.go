@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokens older (or newer) than TOKEN_MAX_AGE seconds are rejected
+const TOKEN_MAX_AGE = 60
+
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrExpiredToken   = errors.New("token expired")
+	ErrBadSignature   = errors.New("bad signature")
+)
+
+// hmac-sha256 of "sessionId.timestamp"
+func sign(secret, sessionId string, timestamp int64) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(sessionId))
+	mac.Write([]byte("."))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	return mac.Sum(nil)
+}
+
+// NewToken returns a token for sessionId in the form "timestamp.hex(hmac)"
+func NewToken(secret, sessionId string, now time.Time) string {
+	timestamp := now.Unix()
+	return strconv.FormatInt(timestamp, 10) + "." + hex.EncodeToString(sign(secret, sessionId, timestamp))
+}
+
+// VerifyToken checks that token was created by NewToken with the same secret
+// and sessionId, and that it is not older than TOKEN_MAX_AGE
+func VerifyToken(secret, sessionId, token string, now time.Time) error {
+	ts, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrMalformedToken
+	}
+
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrMalformedToken
+	}
+
+	signature, err := hex.DecodeString(mac)
+	if err != nil {
+		return ErrMalformedToken
+	}
+
+	age := now.Unix() - timestamp
+	if age > TOKEN_MAX_AGE || age < -TOKEN_MAX_AGE {
+		return ErrExpiredToken
+	}
+
+	if !hmac.Equal(signature, sign(secret, sessionId, timestamp)) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
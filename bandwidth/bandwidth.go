@@ -0,0 +1,153 @@
+// Package bandwidth limits the rate of data with token buckets.
+//
+// A bucket may go into debt: the bytes of a read or write are taken at once,
+// and the caller waits until the bucket is refilled above zero. Datagrams
+// are never split this way.
+package bandwidth
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// a bucket holds at most one second of data, and at least MIN_BURST bytes
+const MIN_BURST = 64 * 1024
+
+// Limiter is a token bucket of bytes per second, whose rate can be changed
+// while it is used. A nil *Limiter does not limit.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    int64   // bytes per second, 0 for no limit
+	tokens  float64 // bytes which may pass at once, negative when in debt
+	updated time.Time
+}
+
+// NewLimiter returns a limiter of rate bytes per second, 0 for no limit
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		tokens:  burst(rate),
+		updated: time.Now(),
+	}
+}
+
+func burst(rate int64) float64 {
+	return float64(max(rate, MIN_BURST))
+}
+
+// refill the tokens until now
+//
+// l.mu must be held
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens = min(burst(l.rate), l.tokens+now.Sub(l.updated).Seconds()*float64(l.rate))
+	}
+	l.updated = now
+}
+
+// SetRate changes the rate of l, a debt is paid at the new rate
+func (l *Limiter) SetRate(rate int64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.rate = rate
+	l.tokens = min(l.tokens, burst(rate))
+}
+
+// Rate returns the rate of l in bytes per second, 0 for no limit
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// take n bytes, and return how long to wait before they may pass
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Wait takes n bytes from every limiter, and waits until they may pass all
+// of them. nil limiters are skipped.
+//
+// it returns net.ErrClosed if done is closed first
+func Wait(done <-chan struct{}, n int, limiters ...*Limiter) error {
+	var delay time.Duration
+	for _, l := range limiters {
+		if l != nil {
+			delay = max(delay, l.reserve(n))
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return net.ErrClosed
+	}
+}
+
+// NewConn returns conn limiting the bytes read from it by read, and the
+// bytes written to it by write, until done is closed
+func NewConn(conn net.Conn, done <-chan struct{}, read []*Limiter, write []*Limiter) net.Conn {
+	return &limitedConn{
+		Conn:  conn,
+		done:  done,
+		read:  read,
+		write: write,
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	done  <-chan struct{}
+	read  []*Limiter
+	write []*Limiter
+}
+
+// the data is read at once, the read returns when it may pass
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		waitErr := Wait(c.done, n, c.read...)
+		if err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	err := Wait(c.done, len(p), c.write...)
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
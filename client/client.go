@@ -1,8 +1,11 @@
 package client
 
 import (
+	"commonweb2/auth"
+	"commonweb2/bandwidth"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -10,65 +13,213 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	utls "github.com/refraction-networking/utls"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 )
 
-type client struct {
-	up         string
-	down       string
-	listen     string
+type Options struct {
+	Up         string        // upload url
+	Down       string        // download url
+	Listen     string        // listen address
+	Secret     string        // shared secret for authenticating requests, empty to disable
+	Inbound    string        // inbound protocol: tcp / socks5 / http
+	Network    string        // tcp / udp
+	UDPTimeout time.Duration // [udp only] idle timeout of udp associations
+
+	// carry local connections as streams over a pool of Mux sessions,
+	// 0 to open one session per connection
+	Mux int
+
+	// resend lost data over new connections when the upload or download
+	// connection is lost, the server must keep the session for ResumeGrace
+	Resume      bool
+	ResumeGrace time.Duration
+	UTLS        bool // enable or disable utls
+	SkipVerify  bool // skip verifying server's SSL certificate
+	HTTP3       bool // send requests over http/3, the urls must be https
+
+	// carry each session over one websocket connection to the upload url,
+	// instead of an upload and a download request
+	WebSocket bool
+
+	// stream: send the upload in one chunked request
+	// packet: send the upload as a series of short requests, for CDNs which
+	// buffer request bodies
+	UploadMode string
+
+	// stream: receive the download in one streamed response
+	// poll: receive the download with a series of short requests, for CDNs
+	// which buffer responses
+	DownloadMode string
+
+	// bytes per second read from (up) and written to (down) the local
+	// connections together, 0 for no limit. Reload changes the limits of
+	// existing connections too.
+	BandwidthUp   int64
+	BandwidthDown int64
+}
+
+// interval of QUIC keep-alive packets when using http/3
+const HTTP3_KEEP_ALIVE = 10 * time.Second
+
+// Client carries local connections to a server over http requests, the
+// connections accepted by Start or the ones opened by DialContext
+type Client struct {
+	up           string
+	down         string
+	listen       string
+	secret       string
+	inbound      string
+	network      string
+	udpTimeout   time.Duration
+	resume       bool
+	grace        time.Duration
+	pool         *muxPool // nil if multiplexing is disabled
+	utls         bool
+	skipVerify   bool
+	http3        bool
+	websocket    bool
+	uploadMode   string
+	downloadMode string
+	httpClient   http.Client
+
+	// closed by stopListening, Start does not listen once closing is set
 	listener   net.Listener
-	httpClient http.Client
+	packetConn net.PacketConn
+	closing    bool
+	listenerMu sync.Mutex
+
+	// the client carrying connections accepted from now on, set by Reload,
+	// nil to carry them with this client
+	next atomic.Pointer[Client]
+
+	life *lifecycle // shared with the clients set by Reload
 }
 
-func NewClient(up, down, listen string, useUTLS, skipVerify bool) *client {
+// NewClient creates a client, the options are checked by Start and
+// DialContext
+func NewClient(opts Options) *Client {
+	return newClient(opts, newLifecycle(opts.BandwidthUp, opts.BandwidthDown))
+}
+
+// create a client carrying its connections with life
+func newClient(opts Options, life *lifecycle) *Client {
+	grace := opts.ResumeGrace
+	if grace <= 0 {
+		grace = RESUME_GRACE
+	}
+
 	httpClient := http.Client{
 		Transport: http.DefaultTransport.(*http.Transport).Clone(),
 	}
 
-	if useUTLS {
+	if opts.HTTP3 {
+		slog.Info("using http/3")
+
+		if opts.UTLS {
+			slog.Warn("utls does not support http/3, using crypto/tls")
+		}
+
+		httpClient.Transport = &http3.RoundTripper{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: opts.SkipVerify,
+			},
+			QuicConfig: &quic.Config{
+				// keep idle sessions alive
+				KeepAlivePeriod: HTTP3_KEEP_ALIVE,
+			},
+		}
+	} else if opts.UTLS {
 		slog.Info("using utls")
 
-		httpClient.Transport.(*http.Transport).DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			tcpConn, err := net.DialTimeout(network, addr, time.Second*30)
-			if err != nil {
-				return nil, fmt.Errorf("dial tls: dial tcp: %w", err)
-			}
+		httpClient.Transport = newUTLSTransport(opts.SkipVerify)
+	} else {
+		slog.Info("using crypto/tls")
 
-			host, _, err := net.SplitHostPort(addr)
-			if err != nil {
-				return nil, fmt.Errorf("dial tls: split host port: %s: %w", addr, err)
-			}
+		httpClient.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = opts.SkipVerify
+	}
 
-			uConn := utls.UClient(tcpConn, &utls.Config{
-				ServerName:         host,
-				InsecureSkipVerify: skipVerify,
-			}, utls.HelloChrome_Auto)
+	httpClient.Transport = &countingTransport{httpClient.Transport}
+
+	c := &Client{
+		up:           opts.Up,
+		down:         opts.Down,
+		listen:       opts.Listen,
+		secret:       opts.Secret,
+		inbound:      opts.Inbound,
+		network:      opts.Network,
+		udpTimeout:   opts.UDPTimeout,
+		resume:       opts.Resume,
+		grace:        grace,
+		utls:         opts.UTLS,
+		skipVerify:   opts.SkipVerify,
+		http3:        opts.HTTP3,
+		websocket:    opts.WebSocket,
+		uploadMode:   opts.UploadMode,
+		downloadMode: opts.DownloadMode,
+		httpClient:   httpClient,
+		life:         life,
+	}
 
-			err = uConn.HandshakeContext(ctx)
-			if err != nil {
-				return nil, fmt.Errorf("dial tls: handshake: %w", err)
-			}
+	if opts.Mux > 0 {
+		c.pool = newMuxPool(c, opts.Mux)
+	}
 
-			return uConn, nil
-		}
-	} else {
-		slog.Info("using crypto/tls")
+	return c
+}
+
+// check the combination of options
+func (c *Client) validate() error {
+	if c.inbound != "" && c.inbound != "tcp" && c.inbound != "socks5" && c.inbound != "http" {
+		return fmt.Errorf("unknown inbound protocol: %s", c.inbound)
+	}
+
+	if c.websocket && (c.resume || c.http3) {
+		return fmt.Errorf("websocket does not support resume or http/3")
+	}
+
+	if c.uploadMode != "" && c.uploadMode != "stream" && c.uploadMode != "packet" {
+		return fmt.Errorf("unknown upload mode: %s", c.uploadMode)
+	}
+	if c.uploadMode == "packet" && (c.resume || c.websocket) {
+		return fmt.Errorf("packet upload does not support resume or websocket")
+	}
 
-		httpClient.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = skipVerify
+	if c.downloadMode != "" && c.downloadMode != "stream" && c.downloadMode != "poll" {
+		return fmt.Errorf("unknown download mode: %s", c.downloadMode)
+	}
+	if c.downloadMode == "poll" && (c.resume || c.websocket) {
+		return fmt.Errorf("poll download does not support resume or websocket")
 	}
 
-	return &client{
-		up:         up,
-		down:       down,
-		listen:     listen,
-		httpClient: httpClient,
+	if c.network == "udp" {
+		if c.inbound != "" && c.inbound != "tcp" {
+			return fmt.Errorf("inbound protocol %s does not support udp", c.inbound)
+		}
+		if c.pool != nil {
+			return fmt.Errorf("multiplexing does not support udp")
+		}
+	} else if c.network != "" && c.network != "tcp" {
+		return fmt.Errorf("unknown network: %s", c.network)
 	}
+
+	return nil
 }
 
-func (c *client) Start() error {
+func (c *Client) Start() error {
+	err := c.validate()
+	if err != nil {
+		return err
+	}
+
+	if c.network == "udp" {
+		return c.startUDP()
+	}
+
 	slog.Info("listening on", "addr", c.listen)
 
 	l, err := net.Listen("tcp", c.listen)
@@ -76,7 +227,14 @@ func (c *client) Start() error {
 		return fmt.Errorf("listen: %w", err)
 	}
 
+	c.listenerMu.Lock()
+	if c.closing {
+		c.listenerMu.Unlock()
+		l.Close()
+		return fmt.Errorf("listen: %w", net.ErrClosed)
+	}
 	c.listener = l
+	c.listenerMu.Unlock()
 
 	for {
 		conn, err := l.Accept()
@@ -85,52 +243,220 @@ func (c *client) Start() error {
 		}
 		slog.Debug("new connection", "addr", conn.RemoteAddr())
 
-		go func() {
-			err := c.handleConnection(conn)
+		c.life.carry(conn, func() {
+			defer conn.Close()
+
+			c := c.current()
+
+			inboundConn, destination, err := c.handleInbound(conn)
+			if err != nil {
+				slog.Error("handle inbound", "error", err, "addr", conn.RemoteAddr())
+				return
+			}
+
+			if rc, ok := inboundConn.(*replyConn); ok {
+				err = c.handleReplyConnection(rc, destination)
+			} else {
+				err = c.handleConnection(inboundConn, destination, nil)
+			}
 			if err != nil {
 				slog.Error("handle connection", "error", err)
 			}
-			conn.Close()
-		}()
+		})
 	}
 }
 
-func (c *client) Close() error {
-	c.httpClient.CloseIdleConnections()
-	return c.listener.Close()
+// the client carrying connections accepted from now on
+func (c *Client) current() *Client {
+	next := c.next.Load()
+	if next != nil {
+		return next
+	}
+	return c
 }
 
-func (c *client) handleConnection(conn net.Conn) error {
-	// generate session id
+// Reload applies opts to connections accepted from now on. Connections
+// already accepted keep the options they started with, multiplexed sessions
+// are closed once their streams have ended.
+//
+// the listen address and network can not be changed
+func (c *Client) Reload(opts Options) error {
+	if opts.Listen != c.listen || opts.Network != c.network {
+		return fmt.Errorf("listen address and network can not be reloaded")
+	}
+
+	next := newClient(opts, c.life)
+	err := next.validate()
+	if err != nil {
+		return err
+	}
+	c.life.up.SetRate(opts.BandwidthUp)
+	c.life.down.SetRate(opts.BandwidthDown)
+
+	prev := c.current()
+	c.next.Store(next)
+
+	prev.httpClient.CloseIdleConnections()
+	if prev.pool != nil {
+		prev.pool.Close()
+	}
+
+	return nil
+}
+
+// handleInbound performs the handshake of the inbound protocol and returns
+// the connection to tunnel and the destination requested by the local
+// application
+//
+// an empty destination means the server's default remote
+func (c *Client) handleInbound(conn net.Conn) (net.Conn, string, error) {
+	switch c.inbound {
+	case "", "tcp":
+		return conn, "", nil
+	case "socks5":
+		destination, err := socks5Handshake(conn)
+		if err != nil {
+			return nil, "", err
+		}
+		return newReplyConn(conn, sendSocks5Reply), destination, nil
+	case "http":
+		return httpProxyHandshake(conn)
+	default:
+		return nil, "", fmt.Errorf("unknown inbound protocol: %s", c.inbound)
+	}
+}
+
+// generate a random session id
+func newSessionId() string {
 	sessionId := make([]byte, 8)
 	_, err := rand.Read(sessionId)
 	if err != nil {
 		panic("rand: " + err.Error())
 	}
-	sessionIdHex := hex.EncodeToString(sessionId)
+	return hex.EncodeToString(sessionId)
+}
+
+// a session carried by an upload and a download request
+type sessionInfo struct {
+	id          string
+	destination string // destination requested by the local application, empty for remote
+	mux         bool   // the session carries multiplexed streams
+
+	// told whether the session was established, nil if nobody waits for it
+	ready chan<- error
+}
+
+// report whether the session was established, only the first report is
+// delivered
+func (info sessionInfo) established(err error) {
+	if info.ready == nil {
+		return
+	}
+
+	select {
+	case info.ready <- err:
+	default:
+	}
+}
+
+// a request of a session was answered with an unexpected status
+type statusError struct {
+	code   int
+	status string
+}
 
-	slog.Info("new session", "sessionId", sessionIdHex, "conn", conn.RemoteAddr())
+func newStatusError(resp *http.Response) error {
+	return &statusError{code: resp.StatusCode, status: resp.Status}
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
+func (e *statusError) Error() string {
+	return e.status
+}
 
-	upRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, c.up, conn)
+// create an upload or download request of a session
+func (c *Client) newRequest(ctx context.Context, method string, url string, body io.Reader, info sessionInfo) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("X-Session-Id", info.id)
+	if c.secret != "" {
+		req.Header.Add("X-Auth-Token", auth.NewToken(c.secret, info.id, time.Now()))
+	}
+	if info.destination != "" {
+		req.Header.Add("X-Destination", info.destination)
+	}
+	if c.network == "udp" {
+		req.Header.Add("X-Network", "udp")
+	}
+	if info.mux {
+		req.Header.Add("X-Mux", "1")
+	}
+	if c.uploadMode == "packet" {
+		req.Header.Add("X-Upload", "packet")
+	}
+	if c.downloadMode == "poll" {
+		req.Header.Add("X-Download", "poll")
+	}
+
+	return req, nil
+}
+
+// tunnel conn to destination, over its own session or a stream of a
+// multiplexed session
+//
+// whether the session or stream was established is sent to ready, if it is
+// not nil
+func (c *Client) handleConnection(conn net.Conn, destination string, ready chan<- error) error {
+	conn = bandwidth.NewConn(conn, c.life.ctx.Done(), []*bandwidth.Limiter{c.life.up}, []*bandwidth.Limiter{c.life.down})
+
+	if c.pool != nil {
+		return c.pool.handleConnection(conn, destination, ready)
+	}
+
+	return c.handleSession(conn, sessionInfo{id: newSessionId(), destination: destination, ready: ready})
+}
+
+// carry conn over the upload and download requests of one session
+func (c *Client) handleSession(conn net.Conn, info sessionInfo) error {
+	if c.websocket {
+		return c.handleWebSocketSession(conn, info)
+	}
+	if c.resume {
+		return c.handleResumableConnection(conn, info)
+	}
+
+	sessionIdHex := info.id
+
+	slog.Info("new session", "sessionId", sessionIdHex, "conn", conn.RemoteAddr(), "destination", info.destination, "mux", info.mux)
+
+	ctx, cancel := context.WithCancel(c.life.ctx)
+
+	upRequest, err := c.newRequest(ctx, http.MethodPost, c.up, conn, info)
 	if err != nil {
 		cancel()
 		return fmt.Errorf("new upload request: %w", err)
 	}
-	upRequest.Header.Add("X-Session-Id", sessionIdHex)
 
-	downRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, c.down, nil)
+	downRequest, err := c.newRequest(ctx, http.MethodGet, c.down, nil, info)
 	if err != nil {
 		cancel()
 		return fmt.Errorf("new download request: %w", err)
 	}
-	downRequest.Header.Add("X-Session-Id", sessionIdHex)
 
 	// up
 	go func() {
-		defer cancel()
-		defer slog.Debug("context cancel by up", "sessionId", sessionIdHex)
+		if c.uploadMode == "packet" {
+			err := c.packetUpload(ctx, conn, info)
+			if err != nil {
+				slog.Error("upload packet", "error", err, "sessionId", sessionIdHex)
+				info.established(fmt.Errorf("upload packet: %w", err))
+				cancel()
+				slog.Debug("context cancel by up", "sessionId", sessionIdHex)
+			}
+			return
+		}
 
 		resp, err := c.httpClient.Do(upRequest)
 		if err != nil {
@@ -139,6 +465,9 @@ func (c *client) handleConnection(conn net.Conn) error {
 			if !(unwrap != nil && errors.Is(unwrap, context.Canceled)) {
 				slog.Error("upload request", "error", err, "sessionId", sessionIdHex)
 			}
+			info.established(fmt.Errorf("upload request: %w", err))
+			cancel()
+			slog.Debug("context cancel by up", "sessionId", sessionIdHex)
 			return
 		}
 
@@ -146,6 +475,17 @@ func (c *client) handleConnection(conn net.Conn) error {
 
 		slog.Debug("upload reqeust", "status", resp.Status, "sessionId", sessionIdHex)
 
+		if resp.StatusCode != http.StatusOK {
+			slog.Error("upload request", "status", resp.Status, "sessionId", sessionIdHex)
+			info.established(fmt.Errorf("upload request: %w", newStatusError(resp)))
+			cancel()
+			slog.Debug("context cancel by up", "sessionId", sessionIdHex)
+			return
+		}
+
+		// the server ends the download connection when the session ends,
+		// do not cancel here or the download may be cut off before all
+		// data is copied
 		io.Copy(io.Discard, resp.Body)
 	}()
 
@@ -154,6 +494,15 @@ func (c *client) handleConnection(conn net.Conn) error {
 		defer cancel()
 		defer slog.Debug("context cancel by down", "sessionId", sessionIdHex)
 
+		if c.downloadMode == "poll" {
+			err := c.pollDownload(ctx, conn, info)
+			if err != nil {
+				slog.Error("poll download", "error", err, "sessionId", sessionIdHex)
+				info.established(fmt.Errorf("poll download: %w", err))
+			}
+			return
+		}
+
 		resp, err := c.httpClient.Do(downRequest)
 		if err != nil {
 			unwrap := errors.Unwrap(err)
@@ -161,6 +510,7 @@ func (c *client) handleConnection(conn net.Conn) error {
 			if !(unwrap != nil && errors.Is(unwrap, context.Canceled)) {
 				slog.Error("upload request", "error", err, "sessionId", sessionIdHex)
 			}
+			info.established(fmt.Errorf("download request: %w", err))
 			return
 		}
 
@@ -168,9 +518,12 @@ func (c *client) handleConnection(conn net.Conn) error {
 
 		if resp.StatusCode != http.StatusOK {
 			slog.Error("download request", "status", resp.Status, "sessionId", sessionIdHex)
+			info.established(fmt.Errorf("download request: %w", newStatusError(resp)))
 			return
 		}
 
+		info.established(nil)
+
 		slog.Debug("download reqeust", "status", resp.Status, "sessionId", sessionIdHex)
 
 		_, err = io.Copy(conn, resp.Body)
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// DialContext opens a connection through the tunnel to the server's remote,
+// without a local listener. It returns once the server has connected the
+// session to its remote, or handed it to Accept, or a stream of a
+// multiplexed session has been opened.
+//
+// ctx only bounds the dial, the connection is closed by Close, Shutdown or
+// the end of its session. The connection supports deadlines.
+func (c *Client) DialContext(ctx context.Context) (net.Conn, error) {
+	c = c.current()
+
+	err := c.validate()
+	if err != nil {
+		return nil, err
+	}
+	if c.network == "udp" {
+		return nil, fmt.Errorf("dial: udp is not supported")
+	}
+
+	local, remote := net.Pipe()
+	ready := make(chan error, 1)
+	ended := make(chan error, 1)
+
+	c.life.carry(remote, func() {
+		defer remote.Close()
+
+		err := c.handleConnection(remote, "", ready)
+		if err != nil {
+			slog.Error("handle connection", "error", err)
+		}
+		ended <- err
+	})
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			local.Close()
+			return nil, fmt.Errorf("dial: %w", err)
+		}
+		return local, nil
+	case err := <-ended:
+		// a session may end right after it was established
+		select {
+		case readyErr := <-ready:
+			if readyErr == nil {
+				return local, nil
+			}
+			err = readyErr
+		default:
+		}
+
+		local.Close()
+		if err == nil {
+			err = errors.New("session ended")
+		}
+		return nil, fmt.Errorf("dial: %w", err)
+	case <-ctx.Done():
+		local.Close()
+		return nil, fmt.Errorf("dial: %w", ctx.Err())
+	}
+}
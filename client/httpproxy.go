@@ -0,0 +1,113 @@
+package client
+
+import (
+	"bufio"
+	"commonweb2/mux"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// a net.Conn reading from r instead of the underlying connection
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// write an empty response to the local application
+func httpProxyResponse(conn io.Writer, code int) error {
+	_, err := conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))))
+	return err
+}
+
+// the response status for a session that failed, 403 if the server did not
+// allow the destination, 502 otherwise
+func httpProxyStatus(err error) int {
+	if errors.Is(err, mux.ErrNotAllowed) {
+		return http.StatusForbidden
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.code == http.StatusForbidden {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// httpProxyHandshake reads an http proxy request from conn and returns the
+// requested destination as host:port, and a connection to be used for the
+// rest of the stream
+//
+// for CONNECT requests, "200 Connection established" is sent to the local
+// application once the session is established, and the stream after the
+// request is tunneled
+//
+// for requests with an absolute uri (e.g. GET http://example.com/ HTTP/1.1),
+// the request is rewritten to origin form and sent through the tunnel,
+// followed by the rest of the stream
+//
+// if the session fails, an empty response with the status of httpProxyStatus
+// is sent instead
+func httpProxyHandshake(conn net.Conn) (net.Conn, string, error) {
+	reader := bufio.NewReader(conn)
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("http proxy: read request: %w", err)
+	}
+
+	if req.Method == http.MethodConnect {
+		destination := req.Host
+		if _, _, err := net.SplitHostPort(destination); err != nil {
+			destination = net.JoinHostPort(destination, "443")
+		}
+
+		// the reader may have buffered data sent after the request
+		return newReplyConn(&readerConn{Conn: conn, r: reader}, func(conn net.Conn, err error) error {
+			if err != nil {
+				return httpProxyResponse(conn, httpProxyStatus(err))
+			}
+			_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			return err
+		}), destination, nil
+	}
+
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" || req.URL.Host == "" {
+		httpProxyResponse(conn, http.StatusBadRequest)
+		return nil, "", fmt.Errorf("http proxy: not a proxy request: %s %s", req.Method, req.RequestURI)
+	}
+
+	destination := req.URL.Host
+	if _, _, err := net.SplitHostPort(destination); err != nil {
+		destination = net.JoinHostPort(destination, "80")
+	}
+
+	// remove hop-by-hop headers meant for the proxy
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+
+	// one request per connection, later requests on the same connection
+	// may be for a different destination
+	req.Close = true
+
+	// req.Write writes the request in origin form, and reads the body
+	// from reader
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(req.Write(pw))
+	}()
+
+	// the response comes from the destination
+	return newReplyConn(&readerConn{Conn: conn, r: io.MultiReader(pr, reader)}, func(conn net.Conn, err error) error {
+		if err != nil {
+			return httpProxyResponse(conn, httpProxyStatus(err))
+		}
+		return nil
+	}), destination, nil
+}
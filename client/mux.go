@@ -0,0 +1,166 @@
+package client
+
+import (
+	"commonweb2/mux"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// a multiplexed session of the pool
+type muxSession struct {
+	*mux.Session
+	conn net.Conn // local end of the pipe carried by the session's requests
+}
+
+// a pool of multiplexed sessions, local connections are carried as streams
+// of the sessions instead of opening a session each
+type muxPool struct {
+	c        *Client
+	size     int
+	sessions []*muxSession
+	closed   bool
+	sync.Mutex
+}
+
+func newMuxPool(c *Client, size int) *muxPool {
+	return &muxPool{
+		c:    c,
+		size: size,
+	}
+}
+
+// start a session carrying multiplexed streams
+//
+// p.Mutex must be held
+func (p *muxPool) newSession() *muxSession {
+	local, remote := net.Pipe()
+
+	ms := &muxSession{
+		Session: mux.NewSession(local, local, true),
+		conn:    local,
+	}
+
+	p.c.life.wg.Add(1)
+	go func() {
+		defer p.c.life.wg.Done()
+
+		info := sessionInfo{id: newSessionId(), mux: true}
+
+		err := p.c.handleSession(remote, info)
+		if err != nil {
+			slog.Error("handle mux session", "error", err, "sessionId", info.id)
+		}
+
+		remote.Close()
+		ms.Close()
+		local.Close()
+	}()
+
+	p.sessions = append(p.sessions, ms)
+	return ms
+}
+
+// open a stream on the session with the fewest streams, a new session is
+// started if the pool is not full and every session is in use
+func (p *muxPool) open(destination string) (*mux.Stream, error) {
+	p.Lock()
+
+	if p.closed {
+		p.Unlock()
+		return nil, mux.ErrSessionClosed
+	}
+
+	// drop sessions that have ended
+	alive := p.sessions[:0]
+	for _, ms := range p.sessions {
+		select {
+		case <-ms.Done():
+		default:
+			alive = append(alive, ms)
+		}
+	}
+	clear(p.sessions[len(alive):])
+	p.sessions = alive
+
+	var best *muxSession
+	for _, ms := range p.sessions {
+		if best == nil || ms.NumStreams() < best.NumStreams() {
+			best = ms
+		}
+	}
+
+	if best == nil || (best.NumStreams() > 0 && len(p.sessions) < p.size) {
+		best = p.newSession()
+	}
+
+	p.Unlock()
+
+	return best.Open(destination)
+}
+
+// carry conn as a stream of a pooled session
+func (p *muxPool) handleConnection(conn net.Conn, destination string, ready chan<- error) error {
+	info := sessionInfo{ready: ready}
+
+	st, err := p.open(destination)
+	if err != nil {
+		info.established(err)
+		return err
+	}
+	defer p.closeIdle()
+	defer st.Close()
+
+	// the server connects the stream to its destination
+	err = st.Wait()
+	if err != nil {
+		info.established(err)
+		return err
+	}
+	info.established(nil)
+
+	slog.Debug("new stream", "conn", conn.RemoteAddr(), "stream", st.LocalAddr(), "destination", destination)
+
+	go func() {
+		io.Copy(st, conn)
+		st.Close()
+	}()
+
+	io.Copy(conn, st)
+
+	return nil
+}
+
+// close the sessions without streams once the pool is closed
+func (p *muxPool) closeIdle() {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.closed {
+		return
+	}
+
+	alive := p.sessions[:0]
+	for _, ms := range p.sessions {
+		if ms.NumStreams() > 0 {
+			alive = append(alive, ms)
+			continue
+		}
+		ms.Close()
+		ms.conn.Close()
+	}
+	clear(p.sessions[len(alive):])
+	p.sessions = alive
+}
+
+// stop opening streams on the pool, its sessions are closed once their
+// streams have ended
+func (p *muxPool) Close() error {
+	p.Lock()
+	p.closed = true
+	p.Unlock()
+
+	p.closeIdle()
+	return nil
+}
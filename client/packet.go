@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the largest amount of data sent in one upload packet
+const PACKET_SIZE = 128 * 1024
+
+// number of upload packets sent at the same time
+const PACKET_CONCURRENCY = 4
+
+// a lost upload packet is sent again this many times
+const PACKET_RETRIES = 2
+
+// delay before sending a lost upload packet again
+const PACKET_RETRY_INTERVAL = 500 * time.Millisecond
+
+// the server has ended the session
+var errSessionEnded = errors.New("session ended")
+
+// send data read from conn as a series of short, numbered POST requests
+//
+// the server reorders the packets, an empty packet ends the upload
+func (c *Client) packetUpload(ctx context.Context, conn io.Reader, info sessionInfo) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, PACKET_CONCURRENCY)
+	var wg sync.WaitGroup
+
+	var failOnce sync.Once
+	var failErr error
+
+	send := func(seq uint64, data []byte) bool {
+		if seq == 0 {
+			// the first packet creates the session on the server, which
+			// refuses later packets of a session it does not know
+			err := c.sendPacket(ctx, info, seq, data)
+			if err != nil {
+				failOnce.Do(func() {
+					failErr = err
+					cancel()
+				})
+				return false
+			}
+			return true
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := c.sendPacket(ctx, info, seq, data)
+			if err != nil {
+				failOnce.Do(func() {
+					failErr = err
+					cancel()
+				})
+			}
+		}()
+		return true
+	}
+
+	buf := make([]byte, PACKET_SIZE)
+	var seq uint64
+
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if !send(seq, bytes.Clone(buf[:n])) {
+				break
+			}
+			seq++
+		}
+		if err != nil {
+			send(seq, nil)
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if errors.Is(failErr, errSessionEnded) || errors.Is(failErr, context.Canceled) {
+		return nil
+	}
+	return failErr
+}
+
+// send one upload packet, it is sent again if the request fails
+func (c *Client) sendPacket(ctx context.Context, info sessionInfo, seq uint64, data []byte) error {
+	var err error
+
+	for attempt := 0; attempt <= PACKET_RETRIES; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(PACKET_RETRY_INTERVAL):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var req *http.Request
+		req, err = c.newRequest(ctx, http.MethodPost, c.up, bytes.NewReader(data), info)
+		if err != nil {
+			return fmt.Errorf("new upload request: %w", err)
+		}
+		req.Header.Add("X-Seq", strconv.FormatUint(seq, 10))
+
+		var resp *http.Response
+		resp, err = c.httpClient.Do(req)
+		if err != nil {
+			continue
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusGone:
+			return errSessionEnded
+		default:
+			return fmt.Errorf("upload packet %d: %w", seq, newStatusError(resp))
+		}
+	}
+
+	return fmt.Errorf("upload packet %d: %w", seq, err)
+}
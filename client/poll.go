@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// a failed poll is sent again this many times
+const POLL_RETRIES = 2
+
+// delay before sending a failed poll again
+const POLL_RETRY_INTERVAL = 500 * time.Millisecond
+
+// receive the download with a series of short GET requests and write it to
+// conn, until the server ends the session
+//
+// each poll carries the number of bytes received so far, the server answers
+// with the data after it, or with nothing after a short wait
+func (c *Client) pollDownload(ctx context.Context, conn io.Writer, info sessionInfo) error {
+	var cursor uint64
+
+	for {
+		data, err := c.poll(ctx, info, cursor)
+		if errors.Is(err, errSessionEnded) || errors.Is(err, context.Canceled) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// the server answers polls once the session is paired
+		info.established(nil)
+
+		if len(data) == 0 {
+			continue
+		}
+
+		_, err = conn.Write(data)
+		if err != nil {
+			slog.Debug("write local connection", "err", err, "sessionId", info.id)
+			return nil
+		}
+
+		cursor += uint64(len(data))
+	}
+}
+
+// send one poll, it is sent again if the request fails
+func (c *Client) poll(ctx context.Context, info sessionInfo, cursor uint64) ([]byte, error) {
+	var err error
+
+	for attempt := 0; attempt <= POLL_RETRIES; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(POLL_RETRY_INTERVAL):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		var req *http.Request
+		req, err = c.newRequest(ctx, http.MethodGet, pollURL(c.down, cursor), nil, info)
+		if err != nil {
+			return nil, fmt.Errorf("new download request: %w", err)
+		}
+		req.Header.Add("X-Cursor", strconv.FormatUint(cursor, 10))
+
+		var resp *http.Response
+		resp, err = c.httpClient.Do(req)
+		if err != nil {
+			continue
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			var data []byte
+			data, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				// the server keeps the data until a later cursor
+				continue
+			}
+			return data, nil
+		case http.StatusGone:
+			resp.Body.Close()
+			return nil, errSessionEnded
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("poll at %d: %w", cursor, newStatusError(resp))
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("poll at %d: %w", cursor, err)
+}
+
+// the url of the poll at cursor, the cursor in the query makes every poll a
+// distinct resource to caches in between
+func pollURL(down string, cursor uint64) string {
+	u, err := url.Parse(down)
+	if err != nil {
+		// newRequest reports the error
+		return down
+	}
+
+	query := u.Query()
+	query.Set("c", strconv.FormatUint(cursor, 10))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
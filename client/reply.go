@@ -0,0 +1,75 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// a connection of an inbound protocol that replies to the local application
+// once the session is established, data from the tunnel waits for the reply
+type replyConn struct {
+	net.Conn
+	// writes the reply for the result of the session to conn
+	send      func(conn net.Conn, err error) error
+	replied   chan struct{}
+	replyOnce sync.Once
+}
+
+func newReplyConn(conn net.Conn, send func(conn net.Conn, err error) error) *replyConn {
+	return &replyConn{Conn: conn, send: send, replied: make(chan struct{})}
+}
+
+func (c *replyConn) Write(p []byte) (int, error) {
+	<-c.replied
+	return c.Conn.Write(p)
+}
+
+// send the reply for the result of the session, only the first reply is sent
+//
+// the connection is closed after a failure
+func (c *replyConn) reply(err error) {
+	c.replyOnce.Do(func() {
+		writeErr := c.send(c.Conn, err)
+		if writeErr != nil || err != nil {
+			c.Conn.Close()
+		}
+		close(c.replied)
+	})
+}
+
+// tunnel conn to destination, the reply is sent once the server has
+// connected the session to the destination, or a stream of a multiplexed
+// session has been opened
+func (c *Client) handleReplyConnection(conn *replyConn, destination string) error {
+	ready := make(chan error, 1)
+	done := make(chan struct{})
+	waited := make(chan struct{})
+	go func() {
+		defer close(waited)
+
+		select {
+		case err := <-ready:
+			conn.reply(err)
+		case <-done:
+		}
+	}()
+
+	err := c.handleConnection(conn, destination, ready)
+	close(done)
+	<-waited
+
+	// the session may end without being established
+	select {
+	case readyErr := <-ready:
+		conn.reply(readyErr)
+	default:
+		if err != nil {
+			conn.reply(err)
+		} else {
+			conn.reply(errors.New("session ended"))
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"commonweb2/resume"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// give up resuming a session when no connection succeeds for this long, if
+// no grace period is configured
+const RESUME_GRACE = 30 * time.Second
+
+// delay before re-issuing a lost upload or download request
+const RESUME_RETRY_INTERVAL = time.Second
+
+// how long to wait for the upload and download requests to end after the
+// stream is done
+const RESUME_LINGER = 5 * time.Second
+
+// the server no longer has the session, it cannot be resumed
+var errSessionLost = errors.New("session lost")
+
+// same as handleConnection, but upload and download requests are re-issued
+// when they are lost, and unacknowledged data is sent again
+func (c *Client) handleResumableConnection(conn net.Conn, info sessionInfo) error {
+	sessionId := info.id
+
+	slog.Info("new session", "sessionId", sessionId, "conn", conn.RemoteAddr(), "destination", info.destination, "mux", info.mux, "resume", true)
+
+	ep := resume.NewEndpoint()
+	defer ep.Close()
+
+	ctx, cancel := context.WithCancel(c.life.ctx)
+	defer cancel()
+
+	// local -> endpoint
+	go func() {
+		io.Copy(ep, conn)
+		ep.CloseWrite()
+	}()
+
+	// endpoint -> local
+	go func() {
+		io.Copy(conn, ep)
+		conn.Close()
+	}()
+
+	// requests reconnect to the session once the server has answered one,
+	// until then a lost request may not have created it
+	var known atomic.Bool
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		err := c.runResumableLeg(ctx, ep, sessionId, "upload", func() (bool, error) {
+			return c.resumableUpload(ctx, ep, info, &known)
+		})
+		if err != nil {
+			slog.Error("upload request", "error", err, "sessionId", sessionId)
+			info.established(fmt.Errorf("upload request: %w", err))
+			cancel()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		err := c.runResumableLeg(ctx, ep, sessionId, "download", func() (bool, error) {
+			return c.resumableDownload(ctx, ep, info, &known)
+		})
+		if err != nil {
+			slog.Error("download request", "error", err, "sessionId", sessionId)
+			info.established(fmt.Errorf("download request: %w", err))
+			cancel()
+		}
+	}()
+
+	select {
+	case <-ep.Done():
+	case <-ctx.Done():
+	}
+
+	// let the requests end on their own, so the last frames are delivered
+	legsDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(legsDone)
+	}()
+
+	select {
+	case <-legsDone:
+	case <-time.After(RESUME_LINGER):
+	}
+
+	slog.Info("session ends", "sessionId", sessionId)
+	return nil
+}
+
+// run one leg of a resumable session, re-issuing the request when it is lost
+//
+// leg returns whether a connection to the server was made, which resets the
+// grace period
+func (c *Client) runResumableLeg(ctx context.Context, ep *resume.Endpoint, sessionId string, name string, leg func() (bool, error)) error {
+	var lostAt time.Time
+
+	for {
+		connected, err := leg()
+
+		if ep.IsDone() || ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errSessionLost) {
+			return err
+		}
+
+		if connected || lostAt.IsZero() {
+			lostAt = time.Now()
+		}
+		if time.Since(lostAt) > c.grace {
+			return fmt.Errorf("resume %s: %w", name, err)
+		}
+
+		slog.Warn("connection lost, resuming", "leg", name, "error", err, "sessionId", sessionId)
+
+		select {
+		case <-time.After(RESUME_RETRY_INTERVAL):
+		case <-ep.Done():
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// create an upload or download request of a resumable session
+func (c *Client) newResumableRequest(ctx context.Context, method string, url string, body io.Reader, info sessionInfo, reconnect bool, offset uint64, connected *atomic.Bool) (*http.Request, error) {
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			connected.Store(true)
+		},
+	})
+
+	req, err := c.newRequest(ctx, method, url, body, info)
+	if err != nil {
+		return nil, err
+	}
+
+	if reconnect {
+		req.Header.Add("X-Resume", "reconnect")
+	} else {
+		req.Header.Add("X-Resume", "new")
+	}
+	req.Header.Add("X-Resume-Offset", strconv.FormatUint(offset, 10))
+
+	return req, nil
+}
+
+// send frames of the endpoint in one upload request, known is set once the
+// server has answered a request of the session
+func (c *Client) resumableUpload(ctx context.Context, ep *resume.Endpoint, info sessionInfo, known *atomic.Bool) (bool, error) {
+	var connected atomic.Bool
+
+	pr, pw := io.Pipe()
+
+	req, err := c.newResumableRequest(ctx, http.MethodPost, c.up, pr, info, known.Load(), ep.SendOffset(), &connected)
+	if err != nil {
+		return false, fmt.Errorf("%w: new upload request: %w", errSessionLost, err)
+	}
+
+	sendErr := make(chan error, 1)
+	go func() {
+		err := ep.ServeSend(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+		} else {
+			pw.Close()
+		}
+		sendErr <- err
+	}()
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		pr.CloseWithError(err)
+		<-sendErr
+		return connected.Load(), err
+	}
+
+	defer resp.Body.Close()
+
+	slog.Debug("upload reqeust", "status", resp.Status, "sessionId", info.id)
+
+	io.Copy(io.Discard, resp.Body)
+
+	// the server may respond before the request body ends
+	pr.CloseWithError(io.ErrUnexpectedEOF)
+	<-sendErr
+
+	if resp.StatusCode != http.StatusOK {
+		return true, fmt.Errorf("%w: upload request: %w", errSessionLost, newStatusError(resp))
+	}
+	known.Store(true)
+
+	return true, nil
+}
+
+// receive frames of the endpoint from one download request, known is set
+// once the server has answered a request of the session
+func (c *Client) resumableDownload(ctx context.Context, ep *resume.Endpoint, info sessionInfo, known *atomic.Bool) (bool, error) {
+	var connected atomic.Bool
+
+	req, err := c.newResumableRequest(ctx, http.MethodGet, c.down, nil, info, known.Load(), ep.RecvOffset(), &connected)
+	if err != nil {
+		return false, fmt.Errorf("%w: new download request: %w", errSessionLost, err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return connected.Load(), err
+	}
+
+	defer resp.Body.Close()
+
+	slog.Debug("download reqeust", "status", resp.Status, "sessionId", info.id)
+
+	if resp.StatusCode != http.StatusOK {
+		return true, fmt.Errorf("%w: download request: %w", errSessionLost, newStatusError(resp))
+	}
+	known.Store(true)
+
+	info.established(nil)
+
+	return true, ep.ServeReceive(resp.Body)
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"commonweb2/bandwidth"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// the connections carried by a client and the clients replacing it on
+// Reload
+type lifecycle struct {
+	// canceled when the connections are closed, the requests of their
+	// sessions are canceled with it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wg    sync.WaitGroup        // goroutines carrying connections
+	conns map[net.Conn]struct{} // local connections being carried
+	sync.Mutex
+
+	// bandwidth of all connections, read from (up) and written to (down)
+	// the local connections
+	up   *bandwidth.Limiter
+	down *bandwidth.Limiter
+}
+
+func newLifecycle(up int64, down int64) *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &lifecycle{
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+		up:     bandwidth.NewLimiter(up),
+		down:   bandwidth.NewLimiter(down),
+	}
+}
+
+// run f in a goroutine carrying conn, conn is closed by closeAll if f has
+// not returned
+func (l *lifecycle) carry(conn net.Conn, f func()) {
+	l.Lock()
+	l.conns[conn] = struct{}{}
+	l.Unlock()
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		f()
+
+		l.Lock()
+		delete(l.conns, conn)
+		l.Unlock()
+	}()
+}
+
+// cancel the requests of every session and close the connections being
+// carried, it returns the number of connections
+func (l *lifecycle) closeAll() int {
+	l.cancel()
+
+	l.Lock()
+	defer l.Unlock()
+
+	for conn := range l.conns {
+		conn.Close()
+	}
+	return len(l.conns)
+}
+
+// stop accepting connections, and close multiplexed sessions once their
+// streams have ended
+func (c *Client) stopListening() error {
+	current := c.current()
+	current.httpClient.CloseIdleConnections()
+	if current.pool != nil {
+		current.pool.Close()
+	}
+
+	c.listenerMu.Lock()
+	defer c.listenerMu.Unlock()
+
+	c.closing = true
+	if c.packetConn != nil {
+		return c.packetConn.Close()
+	}
+	if c.listener != nil {
+		return c.listener.Close()
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for the connections being
+// carried to end. The connections left when ctx is done are closed.
+//
+// it returns once every goroutine carrying a connection has returned
+func (c *Client) Shutdown(ctx context.Context) error {
+	err := c.stopListening()
+
+	done := make(chan struct{})
+	go func() {
+		c.life.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		c.life.cancel()
+	case <-ctx.Done():
+		closed := c.life.closeAll()
+		<-done
+		err = errors.Join(err, fmt.Errorf("%d connections closed at the deadline: %w", closed, ctx.Err()))
+	}
+
+	c.current().httpClient.CloseIdleConnections()
+	return err
+}
+
+// Close stops listening and closes every connection at once
+func (c *Client) Close() error {
+	err := c.stopListening()
+	c.life.closeAll()
+	c.life.wg.Wait()
+	c.current().httpClient.CloseIdleConnections()
+	return err
+}
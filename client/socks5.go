@@ -0,0 +1,153 @@
+package client
+
+import (
+	"bytes"
+	"commonweb2/mux"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// https://www.rfc-editor.org/rfc/rfc1928
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded         = 0x00
+	socks5RepGeneralFailure    = 0x01
+	socks5RepNotAllowed        = 0x02
+	socks5RepHostUnreachable   = 0x04
+	socks5RepCmdNotSupported   = 0x07
+	socks5RepAtypeNotSupported = 0x08
+)
+
+// write a socks5 reply with an unspecified bind address
+func socks5Reply(conn io.Writer, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socks5Handshake reads the method negotiation and the CONNECT request from
+// conn, and returns the requested destination as host:port, the reply is sent
+// once the session is established
+//
+// only the "no authentication required" method and the CONNECT command
+// are supported
+func socks5Handshake(conn io.ReadWriter) (string, error) {
+	// method negotiation
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return "", fmt.Errorf("socks5: read version: %w", err)
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("socks5: unsupported version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", fmt.Errorf("socks5: read methods: %w", err)
+	}
+
+	if !bytes.Contains(methods, []byte{socks5MethodNoAuth}) {
+		conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return "", errors.New("socks5: no acceptable authentication method")
+	}
+
+	_, err = conn.Write([]byte{socks5Version, socks5MethodNoAuth})
+	if err != nil {
+		return "", fmt.Errorf("socks5: write method: %w", err)
+	}
+
+	// request
+	request := make([]byte, 4)
+	_, err = io.ReadFull(conn, request)
+	if err != nil {
+		return "", fmt.Errorf("socks5: read request: %w", err)
+	}
+	if request[0] != socks5Version {
+		return "", fmt.Errorf("socks5: unsupported version %d", request[0])
+	}
+	if request[1] != socks5CmdConnect {
+		socks5Reply(conn, socks5RepCmdNotSupported)
+		return "", fmt.Errorf("socks5: unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AtypIPv4:
+		addr := make([]byte, net.IPv4len)
+		_, err = io.ReadFull(conn, addr)
+		host = net.IP(addr).String()
+	case socks5AtypIPv6:
+		addr := make([]byte, net.IPv6len)
+		_, err = io.ReadFull(conn, addr)
+		host = net.IP(addr).String()
+	case socks5AtypDomain:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(conn, length)
+		if err != nil {
+			break
+		}
+		domain := make([]byte, length[0])
+		_, err = io.ReadFull(conn, domain)
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5RepAtypeNotSupported)
+		return "", fmt.Errorf("socks5: unsupported address type %d", request[3])
+	}
+	if err != nil {
+		return "", fmt.Errorf("socks5: read address: %w", err)
+	}
+
+	port := make([]byte, 2)
+	_, err = io.ReadFull(conn, port)
+	if err != nil {
+		return "", fmt.Errorf("socks5: read port: %w", err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// the reply code for the result of a session
+func socks5ReplyCode(err error) byte {
+	if err == nil {
+		return socks5RepSucceeded
+	}
+
+	if errors.Is(err, mux.ErrNotAllowed) {
+		return socks5RepNotAllowed
+	}
+	if errors.Is(err, mux.ErrOpenFailed) {
+		return socks5RepHostUnreachable
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.code {
+		case http.StatusForbidden:
+			return socks5RepNotAllowed
+		case http.StatusBadGateway:
+			return socks5RepHostUnreachable
+		}
+	}
+	return socks5RepGeneralFailure
+}
+
+// write the socks5 reply for the result of a session
+func sendSocks5Reply(conn net.Conn, err error) error {
+	return socks5Reply(conn, socks5ReplyCode(err))
+}
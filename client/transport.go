@@ -0,0 +1,183 @@
+package client
+
+import (
+	"commonweb2/metrics"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// returned by the http/2 dialer when the server does not negotiate h2
+var errNoHTTP2 = errors.New("server does not support h2")
+
+// utlsTransport sends requests with a utls fingerprint. Requests are sent
+// over http/2 when the server negotiates h2 with ALPN, so the upload and
+// download requests share one connection, and over http/1.1 otherwise.
+type utlsTransport struct {
+	h1         *http.Transport
+	h2         *http2.Transport
+	skipVerify bool
+	http1Hosts sync.Map // addresses of servers which did not negotiate h2
+}
+
+func newUTLSTransport(skipVerify bool) *utlsTransport {
+	t := &utlsTransport{
+		h1:         http.DefaultTransport.(*http.Transport).Clone(),
+		skipVerify: skipVerify,
+	}
+
+	t.h1.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return t.dialTLS(ctx, network, addr)
+	}
+
+	t.h2 = &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			uConn, err := t.dialTLS(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			if uConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+				// wasting this connection, later requests to addr go
+				// straight to http/1.1
+				uConn.Close()
+				t.http1Hosts.Store(addr, true)
+				return nil, errNoHTTP2
+			}
+
+			return uConn, nil
+		},
+	}
+
+	return t
+}
+
+// dial a tls connection to addr with the fingerprint of chrome, which offers
+// both h2 and http/1.1 with ALPN
+func (t *utlsTransport) dialTLS(ctx context.Context, network, addr string) (*utls.UConn, error) {
+	return dialUTLS(ctx, network, addr, t.skipVerify, nil)
+}
+
+// dial a tls connection to addr with the fingerprint of chrome
+//
+// alpn replaces the protocols offered by chrome if it is not nil
+func dialUTLS(ctx context.Context, network, addr string, skipVerify bool, alpn []string) (*utls.UConn, error) {
+	tcpConn, err := net.DialTimeout(network, addr, time.Second*30)
+	if err != nil {
+		return nil, fmt.Errorf("dial tls: dial tcp: %w", err)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		tcpConn.Close()
+		return nil, fmt.Errorf("dial tls: split host port: %s: %w", addr, err)
+	}
+
+	config := &utls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: skipVerify,
+	}
+
+	var uConn *utls.UConn
+	if alpn == nil {
+		uConn = utls.UClient(tcpConn, config, utls.HelloChrome_Auto)
+	} else {
+		spec, err := utls.UTLSIdToSpec(utls.HelloChrome_Auto)
+		if err != nil {
+			tcpConn.Close()
+			return nil, fmt.Errorf("dial tls: client hello spec: %w", err)
+		}
+
+		for _, ext := range spec.Extensions {
+			if alpnExt, ok := ext.(*utls.ALPNExtension); ok {
+				alpnExt.AlpnProtocols = alpn
+			}
+		}
+
+		uConn = utls.UClient(tcpConn, config, utls.HelloCustom)
+		err = uConn.ApplyPreset(&spec)
+		if err != nil {
+			tcpConn.Close()
+			return nil, fmt.Errorf("dial tls: apply client hello spec: %w", err)
+		}
+	}
+
+	err = uConn.HandshakeContext(ctx)
+	if err != nil {
+		tcpConn.Close()
+		return nil, fmt.Errorf("dial tls: handshake: %w", err)
+	}
+
+	return uConn, nil
+}
+
+func (t *utlsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return t.h1.RoundTrip(req)
+	}
+
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "443")
+	}
+
+	if _, ok := t.http1Hosts.Load(addr); ok {
+		return t.h1.RoundTrip(req)
+	}
+
+	resp, err := t.h2.RoundTrip(req)
+	if errors.Is(err, errNoHTTP2) {
+		// nothing has been sent yet, the request can be sent again
+		return t.h1.RoundTrip(req)
+	}
+
+	return resp, err
+}
+
+func (t *utlsTransport) CloseIdleConnections() {
+	t.h1.CloseIdleConnections()
+	t.h2.CloseIdleConnections()
+}
+
+// countingTransport counts failed upload (POST) and download (GET) requests
+//
+// requests canceled by the client and 410 Gone, which ends packet uploads
+// and polls, are not failures
+type countingTransport struct {
+	http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+
+	failed := false
+	if err != nil {
+		failed = !errors.Is(err, context.Canceled)
+	} else {
+		failed = resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusGone
+	}
+
+	if failed {
+		direction := "download"
+		if req.Method == http.MethodPost {
+			direction = "upload"
+		}
+		metrics.ClientRequestErrors.Inc(direction)
+	}
+
+	return resp, err
+}
+
+func (t *countingTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,220 @@
+package client
+
+import (
+	"commonweb2/datagram"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// associations idle for longer than this are closed if no timeout is configured
+const UDP_TIMEOUT = 60 * time.Second
+
+// datagrams received from a peer while the upload is busy are dropped once
+// this many are queued
+const UDP_QUEUE_SIZE = 64
+
+// udpConn is a net.Conn for one udp peer of the listener
+//
+// Read returns the datagrams sent by the peer, framed by the datagram
+// package. Write accepts framed datagrams from the download stream and sends
+// them to the peer.
+type udpConn struct {
+	pc         net.PacketConn
+	peer       net.Addr
+	queue      chan []byte
+	pending    []byte // framed datagrams not yet read
+	downBuf    []byte // incomplete frame from the download stream
+	lastActive atomic.Int64
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func newUDPConn(pc net.PacketConn, peer net.Addr) *udpConn {
+	c := &udpConn{
+		pc:    pc,
+		peer:  peer,
+		queue: make(chan []byte, UDP_QUEUE_SIZE),
+		done:  make(chan struct{}),
+	}
+	c.lastActive.Store(time.Now().Unix())
+	return c
+}
+
+// queue a datagram received from the peer
+func (c *udpConn) push(p []byte) {
+	c.lastActive.Store(time.Now().Unix())
+
+	select {
+	case c.queue <- p:
+	default:
+		slog.Debug("udp queue full, dropping datagram", "peer", c.peer)
+	}
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		select {
+		case d := <-c.queue:
+			c.pending = datagram.Append(c.pending[:0], d)
+		case <-c.done:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.lastActive.Store(time.Now().Unix())
+
+	c.downBuf = append(c.downBuf, p...)
+
+	for {
+		d, rest, ok := datagram.Next(c.downBuf)
+		if !ok {
+			break
+		}
+
+		_, err := c.pc.WriteTo(d, c.peer)
+		if err != nil {
+			slog.Debug("write datagram", "peer", c.peer, "error", err)
+		}
+
+		c.downBuf = rest
+	}
+
+	// reuse the buffer once all frames are consumed
+	if len(c.downBuf) == 0 {
+		c.downBuf = c.downBuf[:0:0]
+	}
+
+	return len(p), nil
+}
+
+func (c *udpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr                { return c.pc.LocalAddr() }
+func (c *udpConn) RemoteAddr() net.Addr               { return c.peer }
+func (c *udpConn) SetDeadline(t time.Time) error      { return nil }
+func (c *udpConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *udpConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// listen on a udp socket, and forward the datagrams of each peer through
+// its own session
+func (c *Client) startUDP() error {
+	slog.Info("listening on", "addr", c.listen, "network", "udp")
+
+	pc, err := net.ListenPacket("udp", c.listen)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	c.listenerMu.Lock()
+	if c.closing {
+		c.listenerMu.Unlock()
+		pc.Close()
+		return fmt.Errorf("listen: %w", net.ErrClosed)
+	}
+	c.packetConn = pc
+	c.listenerMu.Unlock()
+
+	timeout := c.udpTimeout
+	if timeout <= 0 {
+		timeout = UDP_TIMEOUT
+	}
+
+	var mu sync.Mutex
+	associations := make(map[string]*udpConn)
+
+	// close idle associations
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			mu.Lock()
+			for key, assoc := range associations {
+				if time.Now().Unix()-assoc.lastActive.Load() > int64(timeout.Seconds()) {
+					slog.Debug("udp association timeout", "peer", assoc.peer)
+					assoc.Close()
+					delete(associations, key)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, datagram.MAX_LENGTH)
+
+	for {
+		n, peer, err := pc.ReadFrom(buf)
+		if err != nil {
+			// no datagram can be sent to the peers once the socket is closed
+			mu.Lock()
+			for _, assoc := range associations {
+				assoc.Close()
+			}
+			mu.Unlock()
+
+			return fmt.Errorf("read from: %w", err)
+		}
+
+		p := make([]byte, n)
+		copy(p, buf[:n])
+
+		mu.Lock()
+		assoc, ok := associations[peer.String()]
+		if !ok {
+			slog.Debug("new udp association", "peer", peer)
+
+			assoc = newUDPConn(pc, peer)
+			associations[peer.String()] = assoc
+
+			c.life.carry(assoc, func() {
+				defer func() {
+					mu.Lock()
+					if associations[peer.String()] == assoc {
+						delete(associations, peer.String())
+					}
+					mu.Unlock()
+				}()
+				defer assoc.Close()
+
+				err := c.current().handleConnection(assoc, "", nil)
+				if err != nil {
+					slog.Error("handle connection", "error", err)
+				}
+			})
+		}
+		mu.Unlock()
+
+		assoc.push(p)
+	}
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"bufio"
+	"commonweb2/metrics"
+	"commonweb2/websocket"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// timeout of the websocket handshake, including tls
+const WEBSOCKET_HANDSHAKE_TIMEOUT = 30 * time.Second
+
+// carry conn over one websocket connection to the upload url, instead of an
+// upload and a download request
+func (c *Client) handleWebSocketSession(conn net.Conn, info sessionInfo) error {
+	slog.Info("new session", "sessionId", info.id, "conn", conn.RemoteAddr(), "destination", info.destination, "mux", info.mux, "websocket", true)
+
+	ws, err := c.dialWebSocket(info)
+	if err != nil {
+		metrics.ClientRequestErrors.Inc("upload")
+		return fmt.Errorf("dial websocket: %w", err)
+	}
+	defer ws.Close()
+
+	info.established(nil)
+
+	// end the session when the client closes its connections
+	stop := context.AfterFunc(c.life.ctx, func() {
+		ws.Close()
+	})
+	defer stop()
+
+	// local -> websocket
+	go func() {
+		io.Copy(ws, conn)
+		ws.CloseWrite()
+	}()
+
+	// websocket -> local, until the server answers our close message or
+	// ends the session
+	_, err = io.Copy(conn, ws)
+	if err != nil {
+		slog.Debug("read websocket", "err", err, "sessionId", info.id, "addr", conn.RemoteAddr())
+	}
+
+	slog.Info("session ends", "sessionId", info.id)
+	return nil
+}
+
+// open a websocket connection to the upload url and finish the handshake
+func (c *Client) dialWebSocket(info sessionInfo) (*websocket.Conn, error) {
+	u, err := url.Parse(c.up)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+
+	var secure bool
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "http"
+	case "wss", "https":
+		u.Scheme = "https"
+		secure = true
+	default:
+		return nil, fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.life.ctx, WEBSOCKET_HANDSHAKE_TIMEOUT)
+	defer cancel()
+
+	req, err := c.newRequest(ctx, http.MethodGet, u.String(), nil, info)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+
+	key := websocket.NewKey()
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	// websocket needs http/1.1, h2 is not offered with ALPN
+	var conn net.Conn
+	if secure && c.utls {
+		conn, err = dialUTLS(ctx, "tcp", addr, c.skipVerify, []string{"http/1.1"})
+	} else if secure {
+		dialer := &tls.Dialer{
+			Config: &tls.Config{
+				InsecureSkipVerify: c.skipVerify,
+				NextProtos:         []string{"http/1.1"},
+			},
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("handshake: %w", newStatusError(resp))
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocket.AcceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("handshake: invalid Sec-WebSocket-Accept")
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return websocket.NewConn(conn, br, true), nil
+}
@@ -0,0 +1,637 @@
+// Package config loads the options of commonweb2 from a json or yaml file.
+package config
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of a configuration file, in json or yaml
+type Config struct {
+	Debug bool `yaml:"debug"`
+
+	// serve prometheus metrics at /metrics on this address, empty to disable
+	Metrics string `yaml:"metrics"`
+
+	// serve the admin api on this loopback address or "unix:" socket path,
+	// empty to disable. Requests must carry AdminToken.
+	Admin      string `yaml:"admin"`
+	AdminToken string `yaml:"admin_token"`
+
+	// how long active sessions may finish after SIGTERM or SIGINT
+	ShutdownTimeout Duration `yaml:"shutdown_timeout"`
+
+	Tunnel `yaml:",inline"`
+
+	// run these tunnels instead of the top-level one, each of them starts
+	// with the top-level values
+	Tunnels []Tunnel `yaml:"tunnels"`
+}
+
+// Tunnel holds the options of one client or server. Field names follow the
+// command line flags, with "_" instead of "-".
+type Tunnel struct {
+	Name   string `yaml:"name"`   // shown in logs, the listen address if empty
+	Mode   string `yaml:"mode"`   // server / client
+	Listen string `yaml:"listen"` // listen address
+	Secret string `yaml:"secret"` // shared secret, empty to disable
+
+	// how long a resumable session is kept after losing a connection
+	ResumeGrace Duration `yaml:"resume_grace"`
+
+	// bytes per second of all sessions, sent (up) and received (down) by
+	// the local connections of a client or by the remote connections of a
+	// server
+	BandwidthUp   ByteRate `yaml:"bandwidth_up"`
+	BandwidthDown ByteRate `yaml:"bandwidth_down"`
+
+	// client only
+	Up           string   `yaml:"up"`
+	Down         string   `yaml:"down"`
+	UTLS         bool     `yaml:"utls"`
+	SkipVerify   bool     `yaml:"skip_verify"`
+	Inbound      string   `yaml:"inbound"` // tcp / socks5 / http
+	Network      string   `yaml:"network"` // tcp / udp
+	UDPTimeout   Duration `yaml:"udp_timeout"`
+	Resume       bool     `yaml:"resume"`
+	UploadMode   string   `yaml:"upload_mode"`   // stream / packet
+	DownloadMode string   `yaml:"download_mode"` // stream / poll
+	WebSocket    bool     `yaml:"websocket"`
+	HTTP3        bool     `yaml:"http3"`
+	Mux          int      `yaml:"mux"`
+
+	// server only
+	Remote     string   `yaml:"remote"`
+	H3Listen   string   `yaml:"h3_listen"`
+	CertFile   string   `yaml:"cert"`
+	KeyFile    string   `yaml:"key"`
+	TLS        bool     `yaml:"tls"`
+	AllowCIDR  []string `yaml:"allow_cidr"`
+	AllowPorts []string `yaml:"allow_ports"`
+	Decoy      string   `yaml:"decoy"` // url or directory serving requests which are not tunnel requests
+
+	RateLimit       float64  `yaml:"rate_limit"` // requests per second of one client address
+	RateBurst       int      `yaml:"rate_burst"`
+	MaxSessions     int      `yaml:"max_sessions"` // concurrent sessions of one client address
+	ForwardedHeader string   `yaml:"forwarded_header"`
+	TrustedProxies  []string `yaml:"trusted_proxies"` // networks of the proxies sending forwarded_header
+
+	// bytes per second of each session, and of the sessions of each client
+	// address
+	SessionBandwidthUp   ByteRate `yaml:"session_bandwidth_up"`
+	SessionBandwidthDown ByteRate `yaml:"session_bandwidth_down"`
+	ClientBandwidthUp    ByteRate `yaml:"client_bandwidth_up"`
+	ClientBandwidthDown  ByteRate `yaml:"client_bandwidth_down"`
+
+	// named secrets accepted besides secret, each with the bandwidth of the
+	// sessions it authenticates. Configuration file only.
+	Credentials []Credential `yaml:"credentials"`
+
+	ACMEDomains   []string `yaml:"acme_domains"`
+	ACMECacheDir  string   `yaml:"acme_cache"`
+	ACMEEmail     string   `yaml:"acme_email"`
+	ACMEDirectory string   `yaml:"acme_directory"`
+	ACMECAFile    string   `yaml:"acme_ca"`
+}
+
+// Credential is a named secret of a server, and the bytes per second of the
+// sessions authenticated by it
+type Credential struct {
+	Name          string   `yaml:"name"`
+	Secret        string   `yaml:"secret"`
+	BandwidthUp   ByteRate `yaml:"bandwidth_up"`
+	BandwidthDown ByteRate `yaml:"bandwidth_down"`
+}
+
+// Duration is a time.Duration written as a string like "30s" in
+// configuration files
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set parses s, so Duration can be used as a flag.Value
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode || node.Tag != "!!str" {
+		return fmt.Errorf("must be a duration string like \"30s\"")
+	}
+	return d.Set(node.Value)
+}
+
+// ByteRate is a number of bytes per second, written with an optional K, M
+// or G suffix (powers of 1024) like "512K" or "10M"
+type ByteRate int64
+
+var byteRateUnits = []struct {
+	suffix string
+	size   int64
+}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}}
+
+func (r ByteRate) String() string {
+	for _, unit := range byteRateUnits {
+		if r != 0 && int64(r)%unit.size == 0 {
+			return strconv.FormatInt(int64(r)/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(r), 10)
+}
+
+// Set parses s, so ByteRate can be used as a flag.Value
+func (r *ByteRate) Set(s string) error {
+	number, size := strings.TrimSuffix(strings.ToUpper(s), "B"), int64(1)
+	for _, unit := range byteRateUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, size = strings.TrimSuffix(number, unit.suffix), unit.size
+			break
+		}
+	}
+
+	v, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || v < 0 || v > math.MaxInt64/size {
+		return fmt.Errorf("invalid rate %q", s)
+	}
+	*r = ByteRate(v * size)
+	return nil
+}
+
+func (r *ByteRate) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("must be a rate like \"10M\"")
+	}
+	return r.Set(node.Value)
+}
+
+// Load reads the configuration file at path into c. Values missing from the
+// file are left unchanged.
+//
+// json is valid yaml, the file is read as yaml either way
+func Load(path string, c *Config) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		// empty file
+		return nil
+	}
+
+	err = decodeStruct(doc.Content[0], reflect.ValueOf(c).Elem(), "")
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// decode a mapping node into the struct v field by field, so errors name
+// the field, prefixed with prefix
+func decodeStruct(node *yaml.Node, v reflect.Value, prefix string) error {
+	if node.Kind != yaml.MappingNode {
+		name := strings.TrimSuffix(prefix, ".")
+		if name == "" {
+			name = "configuration"
+		}
+		return fmt.Errorf("line %d: %s: must be a mapping", node.Line, name)
+	}
+
+	fields := make(map[string]reflect.Value)
+	inlined := make(map[reflect.Type]reflect.Value)
+	collectFields(v, fields, inlined)
+
+	// lists of structs are decoded after the other fields, so their elements
+	// can start with the values of an inlined struct of the same type
+	var lists []int
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		name := prefix + key.Value
+
+		f, ok := fields[key.Value]
+		if !ok {
+			return fmt.Errorf("line %d: %s: unknown field", key.Line, name)
+		}
+
+		if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct {
+			lists = append(lists, i)
+			continue
+		}
+
+		err := value.Decode(f.Addr().Interface())
+		if err != nil {
+			return fmt.Errorf("line %d: %s: %s", value.Line, name, decodeErrorMessage(err))
+		}
+	}
+
+	for _, i := range lists {
+		key, value := node.Content[i], node.Content[i+1]
+		name := prefix + key.Value
+		f := fields[key.Value]
+
+		if value.Kind != yaml.SequenceNode {
+			return fmt.Errorf("line %d: %s: must be a list", value.Line, name)
+		}
+
+		f.Set(reflect.MakeSlice(f.Type(), len(value.Content), len(value.Content)))
+		for j, item := range value.Content {
+			if base, ok := inlined[f.Type().Elem()]; ok {
+				f.Index(j).Set(base)
+			}
+
+			err := decodeStruct(item, f.Index(j), fmt.Sprintf("%s[%d].", name, j))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// add the fields of the struct v to fields by their yaml names, including
+// the fields of inlined structs, which are added to inlined by their type
+func collectFields(v reflect.Value, fields map[string]reflect.Value, inlined map[reflect.Type]reflect.Value) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("yaml")
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if opts == "inline" {
+			inlined[t.Field(i).Type] = v.Field(i)
+			collectFields(v.Field(i), fields, inlined)
+			continue
+		}
+		if name != "" && name != "-" {
+			fields[name] = v.Field(i)
+		}
+	}
+}
+
+var lineNumber = regexp.MustCompile(`^line \d+: `)
+
+// the message of an error from decoding one field, without the prefixes
+// added by the yaml package
+func decodeErrorMessage(err error) string {
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+		return lineNumber.ReplaceAllString(typeErr.Errors[0], "")
+	}
+	return err.Error()
+}
+
+// Validate checks the values of every field, the error names the first
+// invalid field
+func (c *Config) Validate() error {
+	if c.Admin != "" && c.AdminToken == "" {
+		return fmt.Errorf("admin_token: must be set with admin")
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout: must not be negative")
+	}
+
+	if len(c.Tunnels) == 0 {
+		return c.Tunnel.validate("")
+	}
+
+	// tunnels are told apart by name in logs and the admin api
+	names := make(map[string]int)
+	listeners := make(map[string]int)
+	for i := range c.Tunnels {
+		prefix := fmt.Sprintf("tunnels[%d].", i)
+
+		err := c.Tunnels[i].validate(prefix)
+		if err != nil {
+			return err
+		}
+
+		key := c.Tunnels[i].ListenKey()
+		if j, ok := listeners[key]; ok {
+			return fmt.Errorf("%slisten: already used by tunnels[%d]", prefix, j)
+		}
+		listeners[key] = i
+
+		name := c.Tunnels[i].String()
+		if j, ok := names[name]; ok {
+			return fmt.Errorf("%sname: %q already used by tunnels[%d]", prefix, name, j)
+		}
+		names[name] = i
+	}
+	return nil
+}
+
+// TunnelList returns the tunnels to run, the top-level tunnel if no list
+// is given
+func (c *Config) TunnelList() []Tunnel {
+	if len(c.Tunnels) == 0 {
+		return []Tunnel{c.Tunnel}
+	}
+	return c.Tunnels
+}
+
+// ListenKey identifies the listener of t, a tunnel whose key changes must
+// be restarted instead of reloaded
+func (t *Tunnel) ListenKey() string {
+	if t.Mode == "client" {
+		return strings.Join([]string{t.Mode, t.Network, t.Listen}, " ")
+	}
+	return strings.Join([]string{t.Mode, t.Listen, t.H3Listen, t.CertFile, t.KeyFile, fmt.Sprint(t.TLS),
+		strings.Join(t.ACMEDomains, ","), t.ACMECacheDir, t.ACMEEmail, t.ACMEDirectory, t.ACMECAFile}, " ")
+}
+
+// String returns the name of t in logs
+func (t *Tunnel) String() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.Mode + " " + t.Listen
+}
+
+// validate the fields of t, prefix is prepended to field names in errors
+func (t *Tunnel) validate(prefix string) error {
+	field := func(name string, format string, a ...any) error {
+		return fmt.Errorf("%s%s: %s", prefix, name, fmt.Sprintf(format, a...))
+	}
+
+	oneOf := func(name string, value string, allowed ...string) error {
+		for _, v := range allowed {
+			if value == v {
+				return nil
+			}
+		}
+		return field(name, "invalid value %q, must be one of %s", value, strings.Join(allowed, " / "))
+	}
+
+	err := oneOf("mode", t.Mode, "server", "client")
+	if err != nil {
+		return err
+	}
+	if t.Listen == "" {
+		return field("listen", "must not be empty")
+	}
+	if t.ResumeGrace < 0 {
+		return field("resume_grace", "must not be negative")
+	}
+
+	if t.Mode == "client" {
+		if t.Up == "" {
+			return field("up", "must not be empty")
+		}
+		if t.Down == "" && !t.WebSocket {
+			return field("down", "must not be empty")
+		}
+
+		checks := []error{
+			oneOf("inbound", t.Inbound, "tcp", "socks5", "http"),
+			oneOf("network", t.Network, "tcp", "udp"),
+			oneOf("upload_mode", t.UploadMode, "stream", "packet"),
+			oneOf("download_mode", t.DownloadMode, "stream", "poll"),
+		}
+		for _, err := range checks {
+			if err != nil {
+				return err
+			}
+		}
+
+		if t.WebSocket && (t.Resume || t.HTTP3) {
+			return field("websocket", "does not support resume or http3")
+		}
+		if t.UploadMode == "packet" && (t.Resume || t.WebSocket) {
+			return field("upload_mode", "packet does not support resume or websocket")
+		}
+		if t.DownloadMode == "poll" && (t.Resume || t.WebSocket) {
+			return field("download_mode", "poll does not support resume or websocket")
+		}
+		if t.Network == "udp" && t.Inbound != "tcp" {
+			return field("inbound", "%s does not support udp", t.Inbound)
+		}
+		if t.Network == "udp" && t.Mux > 0 {
+			return field("mux", "does not support udp")
+		}
+
+		if t.UDPTimeout < 0 {
+			return field("udp_timeout", "must not be negative")
+		}
+		if t.Mux < 0 {
+			return field("mux", "must not be negative")
+		}
+		return nil
+	}
+
+	if t.Remote == "" {
+		return field("remote", "must not be empty")
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		if t.CertFile == "" {
+			return field("cert", "must be set with key")
+		}
+		return field("key", "must be set with cert")
+	}
+	acme := len(t.ACMEDomains) > 0
+	if acme && t.CertFile != "" {
+		return field("acme_domains", "can not be set with cert and key")
+	}
+	if acme && t.ACMECacheDir == "" {
+		return field("acme_cache", "must be set with acme_domains")
+	}
+	if !acme && (t.ACMECacheDir != "" || t.ACMEEmail != "" || t.ACMEDirectory != "" || t.ACMECAFile != "") {
+		return field("acme_domains", "must not be empty when other acme options are set")
+	}
+	for i, domain := range t.ACMEDomains {
+		if domain == "" || strings.ContainsAny(domain, ":/ ") {
+			return field(fmt.Sprintf("acme_domains[%d]", i), "invalid domain %q", domain)
+		}
+	}
+	if t.H3Listen != "" && t.CertFile == "" && !acme {
+		return field("h3_listen", "requires cert and key, or acme_domains")
+	}
+	if t.TLS && t.CertFile == "" && !acme {
+		return field("tls", "requires cert and key, or acme_domains")
+	}
+	for i, network := range t.AllowCIDR {
+		_, err := server.ParseAllowlist([]string{network}, nil)
+		if err != nil {
+			return field(fmt.Sprintf("allow_cidr[%d]", i), "%s", err)
+		}
+	}
+	for i, port := range t.AllowPorts {
+		_, err := server.ParseAllowlist(nil, []string{port})
+		if err != nil {
+			return field(fmt.Sprintf("allow_ports[%d]", i), "%s", err)
+		}
+	}
+	if t.RateLimit < 0 {
+		return field("rate_limit", "must not be negative")
+	}
+	if t.RateBurst < 0 {
+		return field("rate_burst", "must not be negative")
+	}
+	if t.MaxSessions < 0 {
+		return field("max_sessions", "must not be negative")
+	}
+	if strings.ContainsAny(t.ForwardedHeader, ": \t") {
+		return field("forwarded_header", "invalid header name %q", t.ForwardedHeader)
+	}
+	if t.ForwardedHeader != "" && len(t.TrustedProxies) == 0 {
+		return field("trusted_proxies", "must be set with forwarded_header")
+	}
+	for i, network := range t.TrustedProxies {
+		_, err := netip.ParsePrefix(network)
+		if err != nil {
+			return field(fmt.Sprintf("trusted_proxies[%d]", i), "%s", err)
+		}
+	}
+	if t.Decoy != "" {
+		_, err := server.NewDecoy(t.Decoy)
+		if err != nil {
+			return field("decoy", "%s", err)
+		}
+	}
+	names := make(map[string]int)
+	secrets := make(map[string]int)
+	for i, credential := range t.Credentials {
+		name := fmt.Sprintf("credentials[%d].", i)
+		if credential.Name == "" {
+			return field(name+"name", "must not be empty")
+		}
+		if credential.Secret == "" {
+			return field(name+"secret", "must not be empty")
+		}
+		if j, ok := names[credential.Name]; ok {
+			return field(name+"name", "%q already used by credentials[%d]", credential.Name, j)
+		}
+		if j, ok := secrets[credential.Secret]; ok {
+			return field(name+"secret", "already used by credentials[%d]", j)
+		}
+		if credential.Secret == t.Secret {
+			return field(name+"secret", "already used by secret")
+		}
+		names[credential.Name] = i
+		secrets[credential.Secret] = i
+	}
+
+	return nil
+}
+
+// ServerOptions converts t to the options of server.NewServer
+func (t *Tunnel) ServerOptions() (server.Options, error) {
+	// client specified destinations are refused unless an allowlist is given
+	var allow *server.Allowlist
+	if len(t.AllowCIDR) > 0 || len(t.AllowPorts) > 0 {
+		var err error
+		allow, err = server.ParseAllowlist(t.AllowCIDR, t.AllowPorts)
+		if err != nil {
+			return server.Options{}, err
+		}
+	}
+
+	var decoy http.Handler
+	if t.Decoy != "" {
+		var err error
+		decoy, err = server.NewDecoy(t.Decoy)
+		if err != nil {
+			return server.Options{}, err
+		}
+	}
+
+	var trusted []netip.Prefix
+	for _, network := range t.TrustedProxies {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return server.Options{}, err
+		}
+		trusted = append(trusted, prefix)
+	}
+
+	var credentials []server.Credential
+	for _, credential := range t.Credentials {
+		credentials = append(credentials, server.Credential{
+			Name:      credential.Name,
+			Secret:    credential.Secret,
+			Bandwidth: server.Bandwidth{Up: int64(credential.BandwidthUp), Down: int64(credential.BandwidthDown)},
+		})
+	}
+
+	return server.Options{
+		Listen:      t.Listen,
+		Remote:      t.Remote,
+		Secret:      t.Secret,
+		Allow:       allow,
+		Decoy:       decoy,
+		ResumeGrace: time.Duration(t.ResumeGrace),
+		H3Listen:    t.H3Listen,
+		CertFile:    t.CertFile,
+		KeyFile:     t.KeyFile,
+		TLS:         t.TLS,
+
+		RateLimit:       t.RateLimit,
+		RateBurst:       t.RateBurst,
+		MaxSessions:     t.MaxSessions,
+		ForwardedHeader: t.ForwardedHeader,
+		TrustedProxies:  trusted,
+
+		Bandwidth:        server.Bandwidth{Up: int64(t.BandwidthUp), Down: int64(t.BandwidthDown)},
+		SessionBandwidth: server.Bandwidth{Up: int64(t.SessionBandwidthUp), Down: int64(t.SessionBandwidthDown)},
+		ClientBandwidth:  server.Bandwidth{Up: int64(t.ClientBandwidthUp), Down: int64(t.ClientBandwidthDown)},
+		Credentials:      credentials,
+
+		ACMEDomains:   t.ACMEDomains,
+		ACMECacheDir:  t.ACMECacheDir,
+		ACMEEmail:     t.ACMEEmail,
+		ACMEDirectory: t.ACMEDirectory,
+		ACMECAFile:    t.ACMECAFile,
+	}, nil
+}
+
+// ClientOptions converts t to the options of client.NewClient
+func (t *Tunnel) ClientOptions() client.Options {
+	return client.Options{
+		Up:           t.Up,
+		Down:         t.Down,
+		Listen:       t.Listen,
+		Secret:       t.Secret,
+		Inbound:      t.Inbound,
+		Network:      t.Network,
+		UDPTimeout:   time.Duration(t.UDPTimeout),
+		Mux:          t.Mux,
+		Resume:       t.Resume,
+		ResumeGrace:  time.Duration(t.ResumeGrace),
+		UTLS:         t.UTLS,
+		SkipVerify:   t.SkipVerify,
+		HTTP3:        t.HTTP3,
+		WebSocket:    t.WebSocket,
+		UploadMode:   t.UploadMode,
+		DownloadMode: t.DownloadMode,
+
+		BandwidthUp:   int64(t.BandwidthUp),
+		BandwidthDown: int64(t.BandwidthDown),
+	}
+}
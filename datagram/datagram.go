@@ -0,0 +1,55 @@
+package datagram
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// datagrams are sent over a byte stream with a 2 bytes big endian length prefix
+const HEADER_LENGTH = 2
+
+// the largest datagram that can be framed
+const MAX_LENGTH = 65535
+
+// Append appends the framed datagram p to b and returns the extended buffer
+func Append(b []byte, p []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(p)))
+	return append(b, p...)
+}
+
+// Next returns the first complete datagram in b and the rest of b
+//
+// ok is false if b does not contain a complete datagram
+func Next(b []byte) (p []byte, rest []byte, ok bool) {
+	if len(b) < HEADER_LENGTH {
+		return nil, b, false
+	}
+
+	length := int(binary.BigEndian.Uint16(b))
+	if len(b) < HEADER_LENGTH+length {
+		return nil, b, false
+	}
+
+	return b[HEADER_LENGTH : HEADER_LENGTH+length], b[HEADER_LENGTH+length:], true
+}
+
+// Read reads one framed datagram from r into buf, which must be at least
+// MAX_LENGTH bytes long
+func Read(r io.Reader, buf []byte) (int, error) {
+	header := buf[:HEADER_LENGTH]
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header))
+	_, err = io.ReadFull(r, buf[:length])
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+
+	return length, nil
+}
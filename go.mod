@@ -2,13 +2,27 @@ module commonweb2
 
 go 1.21.0
 
-require github.com/refraction-networking/utls v1.6.1
+require (
+	github.com/quic-go/quic-go v0.37.4
+	github.com/refraction-networking/utls v1.6.1
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.19.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/andybalholm/brotli v1.0.5 // indirect
 	github.com/cloudflare/circl v1.3.7 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/golang/mock v1.6.0 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/klauspost/compress v1.16.7 // indirect
-	github.com/quic-go/quic-go v0.37.4 // indirect
-	golang.org/x/crypto v0.17.0 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/quic-go/qpack v0.4.0 // indirect
+	github.com/quic-go/qtls-go1-20 v0.3.1 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/mod v0.10.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/tools v0.9.1 // indirect
 )
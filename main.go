@@ -1,56 +1,294 @@
 package main
 
 import (
-	"commonweb2/client"
-	"commonweb2/server"
+	"commonweb2/admin"
+	"commonweb2/config"
+	"commonweb2/metrics"
+	"context"
 	"flag"
+	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// a comma separated list given on the command line
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(s string) error {
+	*f.list = strings.Split(s, ",")
+	return nil
+}
+
+// define the command line flags on fs, storing their values in c
+func bindFlags(fs *flag.FlagSet, c *config.Config) {
+	c.ShutdownTimeout = config.Duration(30 * time.Second)
+
+	fs.BoolVar(&c.Debug, "debug", false, "enable debug logging")
+	fs.StringVar(&c.Admin, "admin", "", "serve the admin api on this loopback address or unix socket, e.g. 127.0.0.1:9200 or unix:/run/commonweb2.sock")
+	fs.StringVar(&c.AdminToken, "admin-token", "", "token required by the admin api")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout", "how long active sessions may finish after SIGTERM or SIGINT before they are closed")
+	fs.StringVar(&c.Metrics, "metrics", "", "serve prometheus metrics at /metrics on this address, e.g. 127.0.0.1:9100")
+
+	bindTunnelFlags(fs, &c.Tunnel)
+}
+
+// define the command line flags of the top-level tunnel on fs, storing their
+// values in t
+func bindTunnelFlags(fs *flag.FlagSet, t *config.Tunnel) {
+	t.ResumeGrace = config.Duration(30 * time.Second)
+	t.UDPTimeout = config.Duration(time.Minute)
+
+	fs.StringVar(&t.Name, "name", "", "name of the tunnel in logs")
+	fs.StringVar(&t.Mode, "mode", "server", "server / client")
+	fs.BoolVar(&t.UTLS, "utls", false, "[client only] enable or disable utls")
+	fs.StringVar(&t.Up, "up", "http://127.0.0.1:56000/", "[client only] upload url")
+	fs.StringVar(&t.Down, "down", "http://127.0.0.1:56000/", "[client only] download url")
+	fs.StringVar(&t.Remote, "remote", "127.0.0.1:56200", "[server only] remote address")
+	fs.StringVar(&t.Listen, "listen", "127.0.0.1:56100", "listen address")
+	fs.BoolVar(&t.SkipVerify, "skipverify", false, "[client only] skip verifying server's SSL certificate")
+	fs.StringVar(&t.Secret, "secret", "", "shared secret for authenticating sessions, empty to disable")
+	fs.StringVar(&t.Inbound, "inbound", "tcp", "[client only] inbound protocol: tcp / socks5 / http")
+	fs.StringVar(&t.Network, "network", "tcp", "[client only] tcp / udp")
+	fs.Var(&t.UDPTimeout, "udp-timeout", "[client only] idle timeout of udp associations")
+	fs.BoolVar(&t.Resume, "resume", false, "[client only] resume sessions when the upload or download connection is lost")
+	fs.Var(&t.ResumeGrace, "resume-grace", "how long a resumable session is kept after losing a connection")
+	fs.StringVar(&t.UploadMode, "upload-mode", "stream", "[client only] stream / packet, packet sends the upload as a series of short requests")
+	fs.StringVar(&t.DownloadMode, "download-mode", "stream", "[client only] stream / poll, poll receives the download with a series of short requests")
+	fs.BoolVar(&t.WebSocket, "websocket", false, "[client only] carry each session over one websocket connection to the upload url")
+	fs.BoolVar(&t.HTTP3, "http3", false, "[client only] send requests over http/3")
+	fs.StringVar(&t.H3Listen, "h3-listen", "", "[server only] accept http/3 on this udp address, requires -cert and -key")
+	fs.StringVar(&t.CertFile, "cert", "", "[server only] tls certificate file, reloaded when it changes")
+	fs.StringVar(&t.KeyFile, "key", "", "[server only] tls private key file, reloaded when it changes")
+	fs.BoolVar(&t.TLS, "tls", false, "[server only] terminate tls on the tcp listener, requires -cert and -key")
+	fs.Var(listFlag{&t.ACMEDomains}, "acme-domains", "[server only] comma separated domains to obtain certificates for with acme, instead of -cert and -key")
+	fs.StringVar(&t.ACMECacheDir, "acme-cache", "", "[server only] directory keeping the acme certificates and account key")
+	fs.StringVar(&t.ACMEEmail, "acme-email", "", "[server only] contact address of the acme account")
+	fs.StringVar(&t.ACMEDirectory, "acme-directory", "", "[server only] acme directory url, empty for let's encrypt")
+	fs.StringVar(&t.ACMECAFile, "acme-ca", "", "[server only] certificates trusted for the acme directory url, e.g. of a test authority")
+	fs.IntVar(&t.Mux, "mux", 0, "[client only] carry connections over this many multiplexed sessions, 0 to disable")
+	fs.Var(listFlag{&t.AllowCIDR}, "allow-cidr", "[server only] comma separated networks clients may connect to, e.g. 10.0.0.0/8,::1/128")
+	fs.Var(listFlag{&t.AllowPorts}, "allow-ports", "[server only] comma separated ports clients may connect to, e.g. 80,443,8000-9000")
+	fs.Float64Var(&t.RateLimit, "rate-limit", 0, "[server only] requests per second of one client address, 0 for no limit")
+	fs.IntVar(&t.RateBurst, "rate-burst", 0, "[server only] requests one client address may send at once, -rate-limit rounded up if 0")
+	fs.IntVar(&t.MaxSessions, "max-sessions", 0, "[server only] concurrent sessions of one client address, 0 for no limit")
+	fs.StringVar(&t.ForwardedHeader, "forwarded-header", "", "[server only] header holding the client address behind a proxy, e.g. X-Forwarded-For, empty for the source address")
+	fs.Var(listFlag{&t.TrustedProxies}, "trusted-proxies", "[server only] comma separated networks of the proxies -forwarded-header is accepted from, e.g. 10.0.0.0/8")
+	fs.Var(&t.BandwidthUp, "bandwidth-up", "bytes per second sent by all sessions, e.g. 10M, 0 for no limit")
+	fs.Var(&t.BandwidthDown, "bandwidth-down", "bytes per second received by all sessions, e.g. 10M, 0 for no limit")
+	fs.Var(&t.SessionBandwidthUp, "session-bandwidth-up", "[server only] bytes per second sent to remote by each session, 0 for no limit")
+	fs.Var(&t.SessionBandwidthDown, "session-bandwidth-down", "[server only] bytes per second received from remote by each session, 0 for no limit")
+	fs.Var(&t.ClientBandwidthUp, "client-bandwidth-up", "[server only] bytes per second sent to remote by the sessions of one client address, 0 for no limit")
+	fs.Var(&t.ClientBandwidthDown, "client-bandwidth-down", "[server only] bytes per second received from remote by the sessions of one client address, 0 for no limit")
+	fs.StringVar(&t.Decoy, "decoy", "", "[server only] url to proxy, or directory to serve, for requests which are not tunnel requests")
+}
+
+// serve the metrics of every tunnel at /metrics on addr
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	slog.Info("metrics listening on", "addr", addr)
+
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		slog.Error("serve metrics", "error", err)
+	}
+}
+
+// serve the admin api for the servers of ts on addr
+func serveAdmin(addr string, token string, ts *tunnelSet) error {
+	l, err := admin.Listen(addr)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("admin api listening on", "addr", addr)
+
+	go func() {
+		err := http.Serve(l, admin.Handler(token, ts.sources))
+		slog.Error("serve admin api", "error", err)
+	}()
+
+	return nil
+}
+
+// read the configuration file at path
+//
+// values in the file replace the defaults, and flags given on the command
+// line replace values in the file
+func loadConfig(path string) (config.Config, error) {
+	var cfg config.Config
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	bindFlags(fs, &cfg)
+
+	err := config.Load(path, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	// the flags of the top-level tunnel would be ignored by a list of
+	// tunnels, which may not share one value such as the listen address
+	tunnelFlags := flag.NewFlagSet("tunnel", flag.ContinueOnError)
+	bindTunnelFlags(tunnelFlags, &config.Tunnel{})
+
+	flag.Visit(func(f *flag.Flag) {
+		if len(cfg.Tunnels) > 0 && tunnelFlags.Lookup(f.Name) != nil && err == nil {
+			err = fmt.Errorf("-%s: can not be given with tunnels in %s, set it in each tunnel instead", f.Name, path)
+		}
+		if f.Name != "config" {
+			fs.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return cfg, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
 func main() {
-	debug := flag.Bool("debug", false, "enable debug logging")
-	mode := flag.String("mode", "server", "server / client")
-	utls := flag.Bool("utls", false, "[client only] enable or disable utls")
-	up := flag.String("up", "http://127.0.0.1:56000/", "[client only] upload url")
-	down := flag.String("down", "http://127.0.0.1:56000/", "[client only] download url")
-	remote := flag.String("remote", "127.0.0.1:56200", "[server only] remote address")
-	listen := flag.String("listen", "127.0.0.1:56100", "listen address")
-	skipSSLVerify := flag.Bool("skipverify", false, "[client only] skip verifying server's SSL certificate")
+	var cfg config.Config
+	bindFlags(flag.CommandLine, &cfg)
+	configFile := flag.String("config", "", "json or yaml configuration file, flags given on the command line override its values, reloaded on SIGHUP")
 	flag.Parse()
 
-	if *mode != "server" && *mode != "client" {
-		panic("invalid mode")
+	var err error
+	if *configFile != "" {
+		cfg, err = loadConfig(*configFile)
+	} else {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		slog.Error("load configuration", "error", err)
+		os.Exit(1)
 	}
 
-	logLevel := slog.LevelInfo
-	if *debug {
-		logLevel = slog.LevelDebug
+	// the level can be changed by reloading the configuration
+	var logLevel slog.LevelVar
+	if cfg.Debug {
+		logLevel.Set(slog.LevelDebug)
 	}
 
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level:     logLevel,
+		Level:     &logLevel,
 		AddSource: true,
 	})))
 
-	slog.Info("commonweb2", "mode", *mode)
+	metricsAddr := cfg.Metrics
+	if metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	}
 
-	if *mode == "server" {
+	ts := newTunnelSet()
+	ts.apply(cfg.TunnelList())
 
-		s := server.NewServer(*listen, *remote)
-		err := s.Start()
+	// read by the shutdown on SIGTERM or SIGINT, which may follow a reload
+	var shutdownTimeout atomic.Int64
+	shutdownTimeout.Store(int64(cfg.ShutdownTimeout))
+
+	adminAddr := cfg.Admin
+	if adminAddr != "" {
+		err := serveAdmin(adminAddr, cfg.AdminToken, ts)
 		if err != nil {
-			slog.Error("start server", "error", err)
+			slog.Error("serve admin api", "error", err)
+			os.Exit(1)
 		}
+	}
 
-	} else {
+	// reload the configuration file on SIGHUP, sessions which are already
+	// running keep their settings
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGHUP)
 
-		c := client.NewClient(*up, *down, *listen, *utls, *skipSSLVerify)
-		err := c.Start()
-		if err != nil {
-			slog.Error("start client", "error", err)
+		for range ch {
+			if *configFile == "" {
+				slog.Warn("reload configuration", "error", "no configuration file given")
+				continue
+			}
+
+			cfg, err := loadConfig(*configFile)
+			if err != nil {
+				slog.Error("reload configuration", "error", err)
+				continue
+			}
+
+			slog.Info("reload configuration", "file", *configFile)
+
+			if cfg.Metrics != metricsAddr {
+				slog.Warn("reload configuration", "error", "the metrics address can not be changed without a restart")
+			}
+			if cfg.Admin != adminAddr {
+				slog.Warn("reload configuration", "error", "the admin api address can not be changed without a restart")
+			}
+
+			logLevel.Set(slog.LevelInfo)
+			if cfg.Debug {
+				logLevel.Set(slog.LevelDebug)
+			}
+
+			shutdownTimeout.Store(int64(cfg.ShutdownTimeout))
+			ts.apply(cfg.TunnelList())
+		}
+	}()
+
+	// stop accepting connections on SIGTERM or SIGINT, and let active
+	// sessions finish until the timeout, a second signal closes them at once
+	stopped := make(chan struct{})
+	go func() {
+		ts.wait()
+		close(stopped)
+	}()
+
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+
+	var sig os.Signal
+	select {
+	case <-stopped:
+		return
+	case sig = <-ch:
+	}
+
+	timeout := time.Duration(shutdownTimeout.Load())
+	slog.Info("shutting down", "signal", sig, "timeout", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	go func() {
+		select {
+		case sig := <-ch:
+			slog.Warn("closing every session", "signal", sig)
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
 
+	err = ts.shutdown(ctx)
+	if err != nil {
+		slog.Error("shut down", "error", err)
+		os.Exit(1)
 	}
 
+	slog.Info("shut down")
 }
@@ -0,0 +1,247 @@
+// Package metrics counts what clients and servers do and exports the counts
+// in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ServerSessionsActive   = NewGaugeFunc("commonweb2_server_sessions_active", "Sessions whose upload and download connections are paired.")
+	ServerSessionsUnpaired = NewGaugeFunc("commonweb2_server_sessions_unpaired", "Sessions waiting for their upload or download connection.")
+	ServerSessionTimeouts  = NewCounterVec("commonweb2_server_session_timeouts_total", "Sessions closed by the timeout sweeper.", "reason")
+	ServerBytes            = NewCounterVec("commonweb2_server_bytes_total", "Bytes sent to (up) and received from (down) remote.", "direction")
+	ServerDialFailures     = NewCounter("commonweb2_server_remote_dial_failures_total", "Failed connections to remote or a requested destination.")
+	ServerResponses        = NewCounterVec("commonweb2_server_responses_total", "Responses by http status code.", "code")
+	ServerRateLimited      = NewCounterVec("commonweb2_server_rate_limited_total", "Requests refused by the per address limits of requests and sessions.", "limit")
+	ServerDecoyRequests    = NewCounter("commonweb2_server_decoy_requests_total", "Requests which are not tunnel requests, served by the decoy.")
+	ClientRequestErrors    = NewCounterVec("commonweb2_client_request_errors_total", "Failed upload and download requests.", "direction")
+)
+
+// a metric which can be written in the text format
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+}
+
+// the name, help and type lines of a metric
+type desc struct {
+	name string
+	help string
+	typ  string
+}
+
+func (d desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+}
+
+// Counter is a value which only goes up
+type Counter struct {
+	desc
+	v atomic.Uint64
+}
+
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter"}}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeHeader(w)
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// CounterVec is a set of counters told apart by the value of one label
+type CounterVec struct {
+	desc
+	label    string
+	mu       sync.Mutex
+	counters map[string]*atomic.Uint64
+}
+
+func NewCounterVec(name string, help string, label string) *CounterVec {
+	v := &CounterVec{
+		desc:     desc{name, help, "counter"},
+		label:    label,
+		counters: make(map[string]*atomic.Uint64),
+	}
+	register(v)
+	return v
+}
+
+func (v *CounterVec) counter(value string) *atomic.Uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.counters[value]
+	if !ok {
+		c = new(atomic.Uint64)
+		v.counters[value] = c
+	}
+	return c
+}
+
+// Inc adds one to the counter of the label value
+func (v *CounterVec) Inc(value string) {
+	v.counter(value).Add(1)
+}
+
+// Add adds n to the counter of the label value
+func (v *CounterVec) Add(value string, n uint64) {
+	v.counter(value).Add(n)
+}
+
+// Value returns the counter of the label value
+func (v *CounterVec) Value(value string) uint64 {
+	return v.counter(value).Load()
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.counters))
+	for value := range v.counters {
+		values = append(values, value)
+	}
+	v.mu.Unlock()
+
+	sort.Strings(values)
+
+	v.writeHeader(w)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", v.name, v.label, value, v.Value(value))
+	}
+}
+
+// GaugeFunc is a gauge whose value is the sum of the functions added to it,
+// one for each running client or server
+type GaugeFunc struct {
+	desc
+	mu   sync.Mutex
+	next int
+	fns  map[int]func() int64
+}
+
+func NewGaugeFunc(name string, help string) *GaugeFunc {
+	g := &GaugeFunc{
+		desc: desc{name, help, "gauge"},
+		fns:  make(map[int]func() int64),
+	}
+	register(g)
+	return g
+}
+
+// Add adds f to the sum, until remove is called
+func (g *GaugeFunc) Add(f func() int64) (remove func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id := g.next
+	g.next++
+	g.fns[id] = f
+
+	return func() {
+		g.mu.Lock()
+		delete(g.fns, id)
+		g.mu.Unlock()
+	}
+}
+
+// Value returns the sum of the functions
+func (g *GaugeFunc) Value() int64 {
+	g.mu.Lock()
+	fns := make([]func() int64, 0, len(g.fns))
+	for _, f := range g.fns {
+		fns = append(fns, f)
+	}
+	g.mu.Unlock()
+
+	var sum int64
+	for _, f := range fns {
+		sum += f()
+	}
+	return sum
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %d\n", g.name, g.Value())
+}
+
+// WriteText writes every metric in the Prometheus text format
+func WriteText(w io.Writer) {
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	io.WriteString(w, b.String())
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w)
+	})
+}
+
+// CountConn returns conn counting the bytes written to it in the counter
+// of write, and the bytes read from it in the counter of read
+func CountConn(conn net.Conn, v *CounterVec, write string, read string) net.Conn {
+	return &countConn{
+		Conn:  conn,
+		write: v.counter(write),
+		read:  v.counter(read),
+	}
+}
+
+type countConn struct {
+	net.Conn
+	write *atomic.Uint64
+	read  *atomic.Uint64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.write.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,500 @@
+// Package mux carries many streams over one byte stream.
+//
+// Frames:
+//
+//	type (1 byte) | stream id (4 bytes) | length (4 bytes) | payload
+//
+// OPEN opens a stream, its payload is the requested destination (empty for
+// the server's remote). RESULT tells the opening side whether the destination
+// was connected, its payload is one of the Open results (1 byte). DATA
+// carries stream data. WINDOW allows the peer to send more data on a stream,
+// its payload is the increment (4 bytes). CLOSE closes a stream in both
+// directions.
+//
+// Each stream starts with a send window of WINDOW_SIZE bytes, so a slow
+// stream never blocks the other streams of the session.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	frameOpen   = 0
+	frameData   = 1
+	frameWindow = 2
+	frameClose  = 3
+	frameResult = 4
+)
+
+// results of opening a stream, sent by the accepting side
+const (
+	OpenOK         = 0 // the destination was connected
+	OpenNotAllowed = 1 // the destination is not allowed
+	OpenFailed     = 2 // the destination could not be connected
+)
+
+// the largest payload of a frame
+const MAX_FRAME_SIZE = 16 * 1024
+
+// initial send window of each stream
+const WINDOW_SIZE = 256 * 1024
+
+// streams opened by the peer are refused once this many wait to be accepted
+const ACCEPT_BACKLOG = 256
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamClosed  = errors.New("mux: stream closed")
+	ErrNotAllowed    = errors.New("mux: destination not allowed")
+	ErrOpenFailed    = errors.New("mux: destination not connected")
+)
+
+// Session is one end of a multiplexed byte stream
+type Session struct {
+	w   io.Writer
+	wmu sync.Mutex // frames are written whole
+
+	streams  map[uint32]*Stream
+	nextId   uint32
+	acceptCh chan *Stream
+	mu       sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// NewSession starts a session reading frames from r and writing frames to w
+//
+// only the client side opens streams, the server side accepts them
+func NewSession(r io.Reader, w io.Writer, client bool) *Session {
+	s := &Session{
+		w:        w,
+		streams:  make(map[uint32]*Stream),
+		acceptCh: make(chan *Stream, ACCEPT_BACKLOG),
+		done:     make(chan struct{}),
+	}
+	if client {
+		s.nextId = 1
+	}
+
+	go s.readLoop(r)
+
+	return s
+}
+
+// Done is closed when the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason the session was closed
+func (s *Session) Err() error {
+	<-s.done
+	return s.err
+}
+
+// close the session and all of its streams
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		close(s.done)
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		for _, st := range streams {
+			st.closeLocal(ErrSessionClosed)
+		}
+	})
+}
+
+// Close closes the session and all of its streams
+//
+// the underlying reader and writer are not closed
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// NumStreams returns the number of open streams
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// write a whole frame
+func (s *Session) writeFrame(frameType byte, id uint32, payload []byte) error {
+	header := make([]byte, 9, 9+len(payload))
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	select {
+	case <-s.done:
+		return ErrSessionClosed
+	default:
+	}
+
+	_, err := s.w.Write(append(header, payload...))
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
+
+// Open opens a new stream to destination
+func (s *Session) Open(destination string) (*Stream, error) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	default:
+	}
+
+	id := s.nextId
+	s.nextId += 2
+	st := newStream(s, id, destination)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	err := s.writeFrame(frameOpen, id, []byte(destination))
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.done:
+		return nil, ErrSessionClosed
+	}
+}
+
+func (s *Session) readLoop(r io.Reader) {
+	header := make([]byte, 9)
+	payload := make([]byte, MAX_FRAME_SIZE)
+
+	for {
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+
+		if length > MAX_FRAME_SIZE {
+			s.closeWithError(fmt.Errorf("mux: frame too large: %d", length))
+			return
+		}
+
+		_, err = io.ReadFull(r, payload[:length])
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+
+		switch frameType {
+		case frameOpen:
+			if st != nil {
+				s.closeWithError(fmt.Errorf("mux: stream %d already open", id))
+				return
+			}
+
+			st = newStream(s, id, string(payload[:length]))
+
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+
+			select {
+			case s.acceptCh <- st:
+			default:
+				// backlog full, refuse the stream without blocking the loop
+				s.removeStream(id)
+				go s.writeFrame(frameClose, id, nil)
+			}
+
+		case frameData:
+			if st == nil {
+				// the stream was closed locally, drop the data
+				continue
+			}
+
+			err = st.receive(payload[:length])
+			if err != nil {
+				s.closeWithError(err)
+				return
+			}
+
+		case frameWindow:
+			if st == nil {
+				continue
+			}
+			if length != 4 {
+				s.closeWithError(fmt.Errorf("mux: invalid window frame"))
+				return
+			}
+
+			st.addWindow(binary.BigEndian.Uint32(payload[:4]))
+
+		case frameResult:
+			if st == nil {
+				continue
+			}
+			if length != 1 {
+				s.closeWithError(fmt.Errorf("mux: invalid result frame"))
+				return
+			}
+
+			st.setResult(payload[0])
+
+		case frameClose:
+			if st == nil {
+				continue
+			}
+
+			s.removeStream(id)
+			st.closeLocal(io.EOF)
+
+		default:
+			s.closeWithError(fmt.Errorf("mux: unknown frame type: %d", frameType))
+			return
+		}
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+type muxAddr struct {
+	id uint32
+}
+
+func (a muxAddr) Network() string { return "mux" }
+func (a muxAddr) String() string  { return fmt.Sprintf("stream %d", a.id) }
+
+// Stream is a stream of a session, it implements net.Conn without deadlines
+type Stream struct {
+	session     *Session
+	id          uint32
+	destination string
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	recvBuf    []byte
+	consumed   uint32 // bytes read since the last WINDOW frame
+	sendWindow uint32
+	err        error // set when the stream is closed
+	resulted   bool  // the result of opening the stream was received
+	openErr    error // nil if the destination was connected
+}
+
+func newStream(s *Session, id uint32, destination string) *Stream {
+	st := &Stream{
+		session:     s,
+		id:          id,
+		destination: destination,
+		sendWindow:  WINDOW_SIZE,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// Destination returns the destination the stream was opened to
+func (st *Stream) Destination() string {
+	return st.destination
+}
+
+func (st *Stream) receive(p []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.err != nil {
+		return nil
+	}
+
+	if len(st.recvBuf)+len(p) > WINDOW_SIZE {
+		return fmt.Errorf("mux: stream %d exceeded its window", st.id)
+	}
+
+	st.recvBuf = append(st.recvBuf, p...)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *Stream) setResult(result byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.resulted = true
+	switch result {
+	case OpenOK:
+	case OpenNotAllowed:
+		st.openErr = ErrNotAllowed
+	default:
+		st.openErr = ErrOpenFailed
+	}
+	st.cond.Broadcast()
+}
+
+// Wait waits for the accepting side to send the result of opening the
+// stream, it returns ErrNotAllowed or ErrOpenFailed if the destination was
+// not connected, or the error the stream was closed with before the result
+func (st *Stream) Wait() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for !st.resulted && st.err == nil {
+		st.cond.Wait()
+	}
+
+	if st.resulted {
+		return st.openErr
+	}
+	return st.err
+}
+
+// SendResult tells the opening side whether the destination of the stream
+// was connected, result is one of the Open results
+func (st *Stream) SendResult(result byte) error {
+	return st.session.writeFrame(frameResult, st.id, []byte{result})
+}
+
+func (st *Stream) addWindow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// mark the stream closed without notifying the peer
+func (st *Stream) closeLocal(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+
+	for len(st.recvBuf) == 0 && st.err == nil {
+		st.cond.Wait()
+	}
+
+	if len(st.recvBuf) == 0 {
+		err := st.err
+		st.mu.Unlock()
+		if err == ErrStreamClosed {
+			return 0, io.ErrClosedPipe
+		}
+		return 0, err
+	}
+
+	n := copy(p, st.recvBuf)
+	st.recvBuf = st.recvBuf[n:]
+	if len(st.recvBuf) == 0 {
+		st.recvBuf = nil
+	}
+
+	// return the window once half of it has been read
+	st.consumed += uint32(n)
+	var increment uint32
+	if st.consumed >= WINDOW_SIZE/2 && st.err == nil {
+		increment = st.consumed
+		st.consumed = 0
+	}
+	st.mu.Unlock()
+
+	if increment > 0 {
+		st.session.writeFrame(frameWindow, st.id, binary.BigEndian.AppendUint32(nil, increment))
+	}
+
+	return n, nil
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+
+	for written < len(p) {
+		st.mu.Lock()
+		for st.sendWindow == 0 && st.err == nil {
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			st.mu.Unlock()
+			if st.err == io.EOF {
+				return written, io.ErrClosedPipe
+			}
+			return written, st.err
+		}
+
+		n := min(uint32(len(p)-written), st.sendWindow, MAX_FRAME_SIZE)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		err := st.session.writeFrame(frameData, st.id, p[written:written+int(n)])
+		if err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+
+	return written, nil
+}
+
+// Close closes the stream in both directions
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	alreadyClosed := st.err != nil
+	if !alreadyClosed {
+		st.err = ErrStreamClosed
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	st.session.removeStream(st.id)
+
+	if alreadyClosed {
+		return nil
+	}
+
+	return st.session.writeFrame(frameClose, st.id, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr                { return muxAddr{st.id} }
+func (st *Stream) RemoteAddr() net.Addr               { return muxAddr{st.id} }
+func (st *Stream) SetDeadline(t time.Time) error      { return nil }
+func (st *Stream) SetReadDeadline(t time.Time) error  { return nil }
+func (st *Stream) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,433 @@
+// Package resume implements a reliable byte stream that survives the loss of
+// the connections carrying it.
+//
+// Each direction of the stream is carried by a leg (an http request or
+// response body). Data is sent in frames tagged with its offset in the
+// stream, and the receiver acknowledges the offset it has received in the
+// opposite direction. Unacknowledged data is kept in a bounded retransmit
+// buffer, and is sent again when a leg is replaced.
+//
+// Frames:
+//
+//	DATA: type (1 byte) | offset (8 bytes) | length (4 bytes) | payload
+//	ACK:  type (1 byte) | offset (8 bytes)
+//	FIN:  type (1 byte) | offset (8 bytes)
+//
+// FIN marks the end of the stream and occupies one offset, so it is
+// acknowledged by an ACK of its offset + 1. An idle leg repeats its last ACK
+// every KEEPALIVE_INTERVAL, so the loss of its connection is noticed.
+package resume
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	frameData = 0
+	frameAck  = 1
+	frameFin  = 2
+)
+
+// the largest payload of a DATA frame
+const MAX_FRAME_SIZE = 16 * 1024
+
+// size of the retransmit buffer and of the receive buffer
+const BUFFER_SIZE = 1024 * 1024
+
+// how long a leg may stay idle before its last ACK is sent again
+const KEEPALIVE_INTERVAL = 2 * time.Second
+
+var (
+	ErrClosed   = errors.New("resume: endpoint closed")
+	ErrReplaced = errors.New("resume: leg replaced")
+	ErrGap      = errors.New("resume: data missing from stream")
+)
+
+// Endpoint is one end of a resumable stream
+//
+// Read and Write are used by the application. ServeSend and ServeReceive are
+// called once for every leg carrying the stream.
+type Endpoint struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	sendBuf  []byte // unacknowledged data, sendBuf[0] is at offset sendBase
+	sendBase uint64
+	sendFin  bool // no more data will be written
+	finAcked bool // the peer acknowledged our FIN
+	sendGen  uint64
+
+	recvBuf    []byte // received data not yet read by the application
+	recvOff    uint64 // next expected offset
+	recvFin    bool   // the peer sent FIN
+	finAckSent bool   // the ACK of the peer's FIN was written to a leg
+
+	closed   bool
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func NewEndpoint() *Endpoint {
+	e := &Endpoint{
+		done: make(chan struct{}),
+	}
+	e.cond = sync.NewCond(&e.mu)
+	return e
+}
+
+// close e.done once both sides agree the stream has ended
+//
+// e.mu must be held
+func (e *Endpoint) checkDone() {
+	if (e.recvFin && e.finAckSent) || (e.sendFin && e.finAcked) {
+		e.doneOnce.Do(func() {
+			close(e.done)
+		})
+		e.cond.Broadcast()
+	}
+}
+
+// Done is closed when the stream has ended in an orderly way
+func (e *Endpoint) Done() <-chan struct{} {
+	return e.done
+}
+
+// IsDone reports whether Done is closed
+func (e *Endpoint) IsDone() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close aborts the stream, all pending and future calls return ErrClosed
+func (e *Endpoint) Close() error {
+	e.mu.Lock()
+	e.closed = true
+	e.cond.Broadcast()
+	e.mu.Unlock()
+	return nil
+}
+
+// SendOffset returns the offset of the first unacknowledged byte
+func (e *Endpoint) SendOffset() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.sendBase
+}
+
+// RecvOffset returns the number of bytes received in order
+func (e *Endpoint) RecvOffset() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.recvOff
+}
+
+// Read reads data received from the peer, it returns io.EOF once the peer
+// has ended the stream and all data is read
+func (e *Endpoint) Read(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for len(e.recvBuf) == 0 && !e.recvFin && !e.closed {
+		e.cond.Wait()
+	}
+
+	if len(e.recvBuf) > 0 {
+		n := copy(p, e.recvBuf)
+		e.recvBuf = e.recvBuf[n:]
+		e.cond.Broadcast()
+		return n, nil
+	}
+
+	if e.closed {
+		return 0, ErrClosed
+	}
+
+	return 0, io.EOF
+}
+
+// Write queues p to be sent to the peer, it blocks while the retransmit
+// buffer is full
+func (e *Endpoint) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		for len(e.sendBuf) >= BUFFER_SIZE && !e.closed && !e.sendFin {
+			e.cond.Wait()
+		}
+
+		if e.closed {
+			return written, ErrClosed
+		}
+		if e.sendFin {
+			return written, io.ErrClosedPipe
+		}
+
+		n := min(BUFFER_SIZE-len(e.sendBuf), len(p)-written)
+		e.sendBuf = append(e.sendBuf, p[written:written+n]...)
+		written += n
+		e.cond.Broadcast()
+	}
+
+	return written, nil
+}
+
+// CloseWrite ends the stream after all written data is sent
+func (e *Endpoint) CloseWrite() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sendFin = true
+	e.cond.Broadcast()
+	return nil
+}
+
+// Ack discards data before offset from the retransmit buffer
+func (e *Endpoint) Ack(offset uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ack(offset)
+}
+
+// e.mu must be held
+func (e *Endpoint) ack(offset uint64) {
+	end := e.sendBase + uint64(len(e.sendBuf))
+
+	if e.sendFin && offset == end+1 {
+		e.finAcked = true
+		offset = end
+	}
+
+	if offset > e.sendBase && offset <= end {
+		e.sendBuf = e.sendBuf[offset-e.sendBase:]
+		e.sendBase = offset
+	}
+
+	e.cond.Broadcast()
+	e.checkDone()
+}
+
+// ServeSend writes frames to w until the stream is done, the endpoint is
+// closed, a newer leg calls ServeSend or writing to w fails
+//
+// all unacknowledged data is sent again at the start of the leg. ServeSend
+// returns nil if the stream is done.
+func (e *Endpoint) ServeSend(w io.Writer) error {
+	e.mu.Lock()
+	e.sendGen++
+	gen := e.sendGen
+	cursor := e.sendBase
+	finSent := false
+	ackSent := false
+	var lastAck uint64
+	keepalive := false // the leg has been idle, set under e.mu
+	e.cond.Broadcast()
+	e.mu.Unlock()
+
+	ticker := time.NewTicker(KEEPALIVE_INTERVAL)
+	defer ticker.Stop()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				e.mu.Lock()
+				keepalive = true
+				e.cond.Broadcast()
+				e.mu.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 0, 2*9+13+MAX_FRAME_SIZE)
+
+	for {
+		e.mu.Lock()
+
+		for {
+			if e.closed || gen != e.sendGen || e.IsDone() {
+				break
+			}
+			if cursor < e.sendBase {
+				cursor = e.sendBase
+			}
+			if cursor < e.sendBase+uint64(len(e.sendBuf)) {
+				break
+			}
+			if e.sendFin && !finSent {
+				break
+			}
+			if !ackSent || lastAck != e.recvOff || keepalive {
+				break
+			}
+			e.cond.Wait()
+		}
+
+		if e.closed {
+			e.mu.Unlock()
+			return ErrClosed
+		}
+		if gen != e.sendGen {
+			e.mu.Unlock()
+			return ErrReplaced
+		}
+		if e.IsDone() {
+			e.mu.Unlock()
+			return nil
+		}
+
+		buf = buf[:0]
+		keepalive = false // written by the frames below
+
+		ackFin := false
+		if !ackSent || lastAck != e.recvOff || keepalive {
+			buf = append(buf, frameAck)
+			buf = binary.BigEndian.AppendUint64(buf, e.recvOff)
+			lastAck = e.recvOff
+			ackSent = true
+			ackFin = e.recvFin
+		}
+
+		end := e.sendBase + uint64(len(e.sendBuf))
+		if cursor < end {
+			n := min(end-cursor, MAX_FRAME_SIZE)
+			buf = append(buf, frameData)
+			buf = binary.BigEndian.AppendUint64(buf, cursor)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+			buf = append(buf, e.sendBuf[cursor-e.sendBase:cursor-e.sendBase+n]...)
+			cursor += n
+		}
+
+		if e.sendFin && !finSent && cursor == end {
+			buf = append(buf, frameFin)
+			buf = binary.BigEndian.AppendUint64(buf, end)
+			finSent = true
+		}
+
+		e.mu.Unlock()
+
+		_, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+
+		if ackFin {
+			e.mu.Lock()
+			e.finAckSent = true
+			e.checkDone()
+			e.mu.Unlock()
+		}
+	}
+}
+
+// ServeReceive reads frames from r until r ends, the endpoint is closed or
+// the stream is corrupted
+//
+// ServeReceive returns io.EOF if r ends cleanly.
+func (e *Endpoint) ServeReceive(r io.Reader) error {
+	header := make([]byte, 13)
+	payload := make([]byte, MAX_FRAME_SIZE)
+
+	for {
+		_, err := io.ReadFull(r, header[:9])
+		if err != nil {
+			return err
+		}
+
+		frameType := header[0]
+		offset := binary.BigEndian.Uint64(header[1:9])
+
+		switch frameType {
+		case frameData:
+			_, err = io.ReadFull(r, header[9:13])
+			if err != nil {
+				return err
+			}
+
+			length := binary.BigEndian.Uint32(header[9:13])
+			if length > MAX_FRAME_SIZE {
+				return fmt.Errorf("resume: frame too large: %d", length)
+			}
+
+			_, err = io.ReadFull(r, payload[:length])
+			if err != nil {
+				return err
+			}
+
+			err = e.receive(offset, payload[:length])
+			if err != nil {
+				return err
+			}
+
+		case frameAck:
+			e.mu.Lock()
+			if e.closed {
+				e.mu.Unlock()
+				return ErrClosed
+			}
+			e.ack(offset)
+			e.mu.Unlock()
+
+		case frameFin:
+			e.mu.Lock()
+			if e.closed {
+				e.mu.Unlock()
+				return ErrClosed
+			}
+			if offset > e.recvOff {
+				e.mu.Unlock()
+				return ErrGap
+			}
+			if offset == e.recvOff && !e.recvFin {
+				e.recvFin = true
+				e.recvOff++
+				e.cond.Broadcast()
+			}
+			e.mu.Unlock()
+
+		default:
+			return fmt.Errorf("resume: unknown frame type: %d", frameType)
+		}
+	}
+}
+
+// add the part of a DATA frame not yet received to the receive buffer
+func (e *Endpoint) receive(offset uint64, p []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for len(e.recvBuf) >= BUFFER_SIZE && !e.closed {
+		e.cond.Wait()
+	}
+
+	if e.closed {
+		return ErrClosed
+	}
+	if offset > e.recvOff {
+		return ErrGap
+	}
+
+	end := offset + uint64(len(p))
+	if end <= e.recvOff || e.recvFin {
+		// duplicate
+		return nil
+	}
+
+	e.recvBuf = append(e.recvBuf, p[e.recvOff-offset:]...)
+	e.recvOff = end
+	e.cond.Broadcast()
+	return nil
+}
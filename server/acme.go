@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// the first byte of a tls handshake record
+const TLS_RECORD_HANDSHAKE = 0x16
+
+// create the manager obtaining and renewing the certificates of
+// opts.ACMEDomains
+func newACMEManager(opts Options) (*autocert.Manager, error) {
+	httpClient := &http.Client{
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+	}
+
+	if opts.ACMECAFile != "" {
+		b, err := os.ReadFile(opts.ACMECAFile)
+		if err != nil {
+			return nil, fmt.Errorf("acme ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("acme ca: no certificate found in %s", opts.ACMECAFile)
+		}
+
+		httpClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(opts.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(opts.ACMEDomains...),
+		Email:      opts.ACMEEmail,
+		Client: &acme.Client{
+			DirectoryURL: opts.ACMEDirectory,
+			HTTPClient:   httpClient,
+		},
+	}, nil
+}
+
+// start serving acme http-01 challenges received on plain http connections,
+// later requests on such a connection are served by the decoy
+func (s *Server) startACME() {
+	s.plain = s.serveConns(s.acme.HTTPHandler(http.HandlerFunc(s.serveDecoy)))
+}
+
+// whether a plain http request is an acme http-01 challenge
+func isACMEChallenge(target string) bool {
+	return strings.HasPrefix(target, "/.well-known/acme-challenge/")
+}
+
+// tell tls connections from plain http connections on the listener of a
+// server using acme
+//
+// a tls connection is returned, or the plain connection with the bytes read
+// to tell them apart, which is served like a listener without tls
+func (s *Server) acmeConn(conn net.Conn) (net.Conn, error) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("read first byte: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	buffered := &bufferedConn{Conn: conn, r: r}
+
+	if first[0] == TLS_RECORD_HANDSHAKE {
+		return tls.Server(buffered, s.tlsConfig()), nil
+	}
+
+	return buffered, nil
+}
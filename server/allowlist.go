@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+// Allowlist restricts the destinations clients may request
+//
+// an empty network list allows any public address, not loopback, private,
+// link-local, multicast or unspecified ones, an empty port list allows any
+// port
+type Allowlist struct {
+	networks []*net.IPNet
+	ports    []portRange
+}
+
+// ParseAllowlist parses a list of CIDRs (e.g. 10.0.0.0/8, ::1/128) and a list
+// of ports or port ranges (e.g. 443, 8000-9000)
+func ParseAllowlist(networks []string, ports []string) (*Allowlist, error) {
+	a := &Allowlist{}
+
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("allowlist: invalid network %q: %w", network, err)
+		}
+		a.networks = append(a.networks, ipNet)
+	}
+
+	for _, port := range ports {
+		port = strings.TrimSpace(port)
+		if port == "" {
+			continue
+		}
+
+		from, to, isRange := strings.Cut(port, "-")
+		if !isRange {
+			to = from
+		}
+
+		fromPort, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("allowlist: invalid port %q", port)
+		}
+		toPort, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || toPort < fromPort {
+			return nil, fmt.Errorf("allowlist: invalid port %q", port)
+		}
+
+		a.ports = append(a.ports, portRange{from: uint16(fromPort), to: uint16(toPort)})
+	}
+
+	return a, nil
+}
+
+func (a *Allowlist) allowPort(port uint16) bool {
+	if len(a.ports) == 0 {
+		return true
+	}
+
+	for _, r := range a.ports {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Allowlist) allowIP(ip net.IP) bool {
+	if len(a.networks) == 0 {
+		// never reach the server itself or its local network by default
+		return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsMulticast() && !ip.IsUnspecified()
+	}
+
+	for _, n := range a.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPort validates the syntax of destination (host:port) and checks its port
+func (a *Allowlist) checkPort(destination string) error {
+	_, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return fmt.Errorf("invalid destination: %w", err)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return fmt.Errorf("invalid destination port: %s", port)
+	}
+
+	if !a.allowPort(uint16(p)) {
+		return fmt.Errorf("port not allowed: %d", p)
+	}
+
+	return nil
+}
+
+// resolve destination (host:port) and return an allowed ip:port to dial
+//
+// the resolved address is dialed instead of the host name, so the checked
+// address is the one that is connected to
+func (a *Allowlist) resolve(destination string) (string, error) {
+	err := a.checkPort(destination)
+	if err != nil {
+		return "", err
+	}
+
+	host, port, _ := net.SplitHostPort(destination)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", host, err)
+	}
+
+	for _, addr := range addrs {
+		if a.allowIP(addr.IP) {
+			return net.JoinHostPort(addr.IP.String(), port), nil
+		}
+	}
+
+	return "", fmt.Errorf("address not allowed: %s", host)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"commonweb2/bandwidth"
+	"net"
+	"net/netip"
+)
+
+// Bandwidth limits the data of a server, a client address, a credential or a
+// session in bytes per second, 0 for no limit
+type Bandwidth struct {
+	Up   int64 // sent to remote
+	Down int64 // received from remote
+}
+
+// Credential is a named secret, the sessions authenticated by it share its
+// bandwidth limits
+type Credential struct {
+	Name      string
+	Secret    string
+	Bandwidth Bandwidth
+}
+
+// the limits of the credential named name, none if it has been removed
+func (c *settings) credentialBandwidth(name string) Bandwidth {
+	for _, credential := range c.credentials {
+		if credential.Name == name {
+			return credential.Bandwidth
+		}
+	}
+	return Bandwidth{}
+}
+
+// the limiters of the upload and the download
+type limiterPair struct {
+	up   *bandwidth.Limiter
+	down *bandwidth.Limiter
+}
+
+func newLimiterPair(b Bandwidth) limiterPair {
+	return limiterPair{
+		up:   bandwidth.NewLimiter(b.Up),
+		down: bandwidth.NewLimiter(b.Down),
+	}
+}
+
+func (p limiterPair) set(b Bandwidth) {
+	p.up.SetRate(b.Up)
+	p.down.SetRate(b.Down)
+}
+
+// the limiters shared by the sessions of a client address or a credential
+type sharedLimiters struct {
+	limiterPair
+	sessions int // sessions using the limiters, they are dropped at 0
+}
+
+// set the limiters of a new session: its own, the server's, those of its
+// client address if it is known, and those of the credential which
+// authenticated it. The session gives back its share of the limiters of the
+// address and the credential when it is closed.
+func (s *Server) setSessionLimiters(sess *session, addr netip.Addr, credential string) {
+	current := sess.settings
+
+	sess.bandwidth = newLimiterPair(current.sessionBandwidth)
+	sess.shared = []limiterPair{s.bandwidth}
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if addr.IsValid() {
+		shareLimiters(s, sess, s.clients, addr, current.clientBandwidth)
+	}
+	if credential != "" {
+		shareLimiters(s, sess, s.credentials, credential, current.credentialBandwidth(credential))
+	}
+}
+
+// add the limiters of key in m to the shared limiters of sess, created with b
+// if no session uses them
+//
+// s.clientsMu must be held
+func shareLimiters[K comparable](s *Server, sess *session, m map[K]*sharedLimiters, key K, b Bandwidth) {
+	l, ok := m[key]
+	if !ok {
+		l = &sharedLimiters{limiterPair: newLimiterPair(b)}
+		m[key] = l
+	}
+	l.sessions++
+
+	sess.shared = append(sess.shared, l.limiterPair)
+	sess.release = append(sess.release, func() {
+		s.clientsMu.Lock()
+		defer s.clientsMu.Unlock()
+
+		l.sessions--
+		if l.sessions == 0 {
+			delete(m, key)
+		}
+	})
+}
+
+// apply the limits of current to the server, every client address, every
+// credential and every session, including the sessions created before
+func (s *Server) setBandwidth(current *settings) {
+	s.bandwidth.set(current.bandwidth)
+
+	s.clientsMu.Lock()
+	for _, c := range s.clients {
+		c.set(current.clientBandwidth)
+	}
+	for name, c := range s.credentials {
+		c.set(current.credentialBandwidth(name))
+	}
+	s.clientsMu.Unlock()
+
+	s.sessions.Range(func(key, value any) bool {
+		value.(*session).bandwidth.set(current.sessionBandwidth)
+		return true
+	})
+}
+
+// limit the data written to (up) and read from (down) the remote conn of
+// the session
+func (s *session) limitConn(conn net.Conn) net.Conn {
+	up := []*bandwidth.Limiter{s.bandwidth.up}
+	down := []*bandwidth.Limiter{s.bandwidth.down}
+	for _, p := range s.shared {
+		up = append(up, p.up)
+		down = append(down, p.down)
+	}
+
+	return bandwidth.NewConn(conn, s.ch, down, up)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"commonweb2/metrics"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+)
+
+// NewDecoy returns a handler for requests which are not tunnel requests,
+// proxying them to target if it is an http or https url, or serving the
+// files of the directory target otherwise
+func NewDecoy(target string) (http.Handler, error) {
+	u, err := url.Parse(target)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		if u.Host == "" {
+			return nil, fmt.Errorf("decoy: missing host in %q", target)
+		}
+
+		return &httputil.ReverseProxy{
+			// the request is forwarded as it was received, without
+			// X-Forwarded-* headers
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(u)
+			},
+			ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+		}, nil
+	}
+
+	fi, err := os.Stat(target)
+	if err != nil {
+		return nil, fmt.Errorf("decoy: %w", err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("decoy: %s is neither an http url nor a directory", target)
+	}
+
+	return http.FileServer(http.Dir(target)), nil
+}
+
+// answer a request which is not a tunnel request with code, or with the
+// decoy if one is configured
+func (s *Server) refuse(req *request, current *settings, code int) error {
+	if current.decoy == nil {
+		return req.resp.writeStatus(code)
+	}
+
+	return req.decoy()
+}
+
+// serve a request with the current decoy
+func (s *Server) serveDecoy(w http.ResponseWriter, r *http.Request) {
+	decoy := s.settings.Load().decoy
+	if decoy == nil {
+		// removed by Reload while the connection was open
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	metrics.ServerDecoyRequests.Inc()
+	decoy.ServeHTTP(w, r)
+}
@@ -0,0 +1,20 @@
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// serve a connection speaking http/2, either negotiated with tls ALPN or
+// with prior knowledge
+//
+// the upload and download requests of a session may be carried by streams of
+// the same connection
+func (s *Server) serveHTTP2(conn net.Conn) {
+	h2 := &http2.Server{}
+	h2.ServeConn(conn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(s.serveHTTP),
+	})
+}
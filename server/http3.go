@@ -0,0 +1,40 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// accept http/3 requests on s.h3Listen
+//
+// sessions are paired by X-Session-Id like requests received over tcp, so
+// the upload and download requests may use different transports
+func (s *Server) startHTTP3() error {
+	conn, err := net.ListenPacket("udp", s.h3Listen)
+	if err != nil {
+		return fmt.Errorf("listen udp: %w", err)
+	}
+
+	s.h3Conn = conn
+	s.h3 = &http3.Server{
+		Handler: http.HandlerFunc(s.serveHTTP),
+		TLSConfig: &tls.Config{
+			GetCertificate: s.tlsConfig().GetCertificate,
+			NextProtos:     []string{http3.NextProtoH3},
+		},
+	}
+
+	slog.Info("listening on", "addr", s.h3Listen, "protocol", "http/3")
+
+	go func() {
+		err := s.h3.Serve(conn)
+		slog.Debug("http/3 server stops", "error", err)
+	}()
+
+	return nil
+}
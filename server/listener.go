@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+)
+
+// sessions waiting for Accept, further sessions are closed
+const ACCEPT_BACKLOG = 64
+
+// a connection handed out by Accept
+type acceptedConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *acceptedConn) LocalAddr() net.Addr  { return c.local }
+func (c *acceptedConn) RemoteAddr() net.Addr { return c.remote }
+
+// connect a session, or a stream of a multiplexed session, to address
+//
+// if address is empty the session is handed to Accept instead
+func (s *Server) dialRemote(sess *session, network string, address string) (net.Conn, error) {
+	if address != "" {
+		return net.Dial(network, address)
+	}
+
+	if network != "tcp" {
+		return nil, fmt.Errorf("accept: %s sessions are not supported", network)
+	}
+
+	app, conn := net.Pipe()
+
+	accepted := &acceptedConn{Conn: app, local: s.Addr(), remote: app.RemoteAddr()}
+
+	// the session is handed out by its first request, which may be either
+	sess.Lock()
+	clientAddr := sess.upAddr
+	if clientAddr == "" {
+		clientAddr = sess.downAddr
+	}
+	sess.Unlock()
+
+	addrPort, err := netip.ParseAddrPort(clientAddr)
+	if err == nil {
+		accepted.remote = net.TCPAddrFromAddrPort(addrPort)
+	}
+
+	select {
+	case s.accepted <- accepted:
+		slog.Debug("session handed to accept", "sessionId", sess.sessionId)
+		return conn, nil
+	default:
+		app.Close()
+		conn.Close()
+		return nil, errors.New("accept: backlog is full")
+	}
+}
+
+// Accept waits for a session, or a stream of a multiplexed session, which
+// would connect to remote when Options.Remote is empty. Sessions requesting
+// a destination still connect to it.
+//
+// it returns net.ErrClosed once the server is closed
+func (s *Server) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.accepted:
+		return conn, nil
+	case <-s.done:
+		return nil, fmt.Errorf("accept: %w", net.ErrClosed)
+	}
+}
+
+// Addr returns the listen address of the server
+func (s *Server) Addr() net.Addr {
+	s.listenerMu.Lock()
+	l := s.listener
+	s.listenerMu.Unlock()
+
+	if l != nil {
+		return l.Addr()
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", s.listen)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// connections received on the listener of the server which are served by a
+// net/http server instead
+type connListener struct {
+	conns chan net.Conn
+	done  <-chan struct{}
+	addr  net.Addr
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// serve conn with the http server of l, until conn or the server is closed
+func (l *connListener) handOff(conn net.Conn) {
+	c := &notifyConn{Conn: conn, closed: make(chan struct{})}
+
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		return
+	}
+
+	select {
+	case <-c.closed:
+	case <-l.done:
+	}
+}
+
+// a connection which tells when it has been closed
+type notifyConn struct {
+	net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *notifyConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// serve the connections handed off to the returned listener with handler,
+// until the server is closed
+func (s *Server) serveConns(handler http.Handler) *connListener {
+	l := &connListener{
+		conns: make(chan net.Conn),
+		done:  s.done,
+		addr:  s.Addr(),
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		http.Serve(l, handler)
+	}()
+
+	return l
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"commonweb2/metrics"
+	"commonweb2/mux"
+	"io"
+	"log/slog"
+)
+
+// accept the streams of a multiplexed session and connect each of them to
+// remote, or the destination requested for the stream
+//
+// the session ends when the client closes the multiplexed session or the
+// upload or download connection is lost
+func (s *session) copyMux(remote string, allow *Allowlist) {
+	var r io.Reader = s.up
+	var w io.Writer = s.down
+	if s.ep != nil {
+		r, w = s.ep, s.ep
+	}
+
+	ms := mux.NewSession(r, w, false)
+
+	go func() {
+		for {
+			st, err := ms.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serveStream(st, remote, allow)
+		}
+	}()
+
+	select {
+	case <-ms.Done():
+		slog.Debug("mux session closed", "sessionId", s.sessionId, "error", ms.Err())
+	case <-s.ch:
+	}
+
+	ms.Close()
+
+	if s.ep != nil {
+		// let the client acknowledge the end of the stream
+		s.ep.CloseWrite()
+
+		select {
+		case <-s.ep.Done():
+		case <-s.ch:
+		}
+	}
+
+	s.close()
+}
+
+// connect a stream to its destination and copy data
+func (s *session) serveStream(st *mux.Stream, remote string, allow *Allowlist) {
+	defer st.Close()
+
+	destination := st.Destination()
+	if destination != "" {
+		if allow == nil {
+			slog.Warn("destination not allowed", "sessionId", s.sessionId, "stream", st.LocalAddr(), "destination", destination)
+			st.SendResult(mux.OpenNotAllowed)
+			return
+		}
+
+		addr, err := allow.resolve(destination)
+		if err != nil {
+			slog.Warn("destination not allowed", "sessionId", s.sessionId, "stream", st.LocalAddr(), "destination", destination, "error", err)
+			st.SendResult(mux.OpenNotAllowed)
+			return
+		}
+		remote = addr
+	}
+
+	conn, err := s.dial("tcp", remote)
+	if err != nil {
+		metrics.ServerDialFailures.Inc()
+		slog.Error("dial remote", "error", err, "sessionId", s.sessionId, "stream", st.LocalAddr())
+		st.SendResult(mux.OpenFailed)
+		return
+	}
+	st.SendResult(mux.OpenOK)
+	conn = s.limitConn(s.countConn(conn))
+	defer conn.Close()
+
+	slog.Debug("new stream", "sessionId", s.sessionId, "stream", st.LocalAddr(), "destination", destination)
+
+	go func() {
+		io.Copy(conn, st)
+		conn.Close()
+	}()
+
+	io.Copy(st, conn)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the largest body of an upload packet
+const MAX_PACKET_SIZE = 1024 * 1024
+
+// an upload packet waits while it is this many packets ahead of the next
+// packet to be written to remote
+const PACKET_WINDOW = 64
+
+// an upload packet waits while this many bytes are buffered
+const PACKET_BUFFER_SIZE = 4 * 1024 * 1024
+
+var errPacketBufferClosed = errors.New("packet buffer closed")
+
+// packetBuffer reorders upload packets into the upload stream of a session
+//
+// packets are numbered from 0, an empty packet ends the stream
+type packetBuffer struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	next    uint64            // sequence number of the next packet to append to buf
+	pending map[uint64][]byte // packets received ahead of next
+	buf     []byte            // data in order, not yet read
+	end     bool              // the empty packet has been reached
+	closed  bool
+}
+
+func newPacketBuffer() *packetBuffer {
+	b := &packetBuffer{
+		pending: make(map[uint64][]byte),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// add a packet, it blocks while the packet is too far ahead or too much
+// data is buffered
+func (b *packetBuffer) push(seq uint64, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		if b.closed {
+			return errPacketBufferClosed
+		}
+		if _, ok := b.pending[seq]; ok || seq < b.next || b.end {
+			// duplicate
+			return nil
+		}
+		if seq < b.next+PACKET_WINDOW && len(b.buf) < PACKET_BUFFER_SIZE {
+			break
+		}
+		b.cond.Wait()
+	}
+
+	b.pending[seq] = data
+
+	for {
+		p, ok := b.pending[b.next]
+		if !ok {
+			break
+		}
+		delete(b.pending, b.next)
+		b.next++
+
+		if len(p) == 0 {
+			b.end = true
+			clear(b.pending)
+			break
+		}
+		b.buf = append(b.buf, p...)
+	}
+
+	b.cond.Broadcast()
+	return nil
+}
+
+// Read reads the upload stream, it returns io.EOF after the empty packet
+func (b *packetBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.buf) == 0 && !b.end && !b.closed {
+		b.cond.Wait()
+	}
+
+	if len(b.buf) > 0 {
+		n := copy(p, b.buf)
+		b.buf = b.buf[n:]
+		if len(b.buf) == 0 {
+			b.buf = nil
+		}
+		b.cond.Broadcast()
+		return n, nil
+	}
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return 0, io.EOF
+}
+
+// Close wakes up pending reads and pushes
+func (b *packetBuffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	return nil
+}
+
+// handle an upload packet of a session
+//
+// the response is sent once the packet is buffered, so the client may send
+// a bounded number of packets ahead
+func (s *Server) handlePacketUpload(req *request, sess *session) error {
+	seq, err := strconv.ParseUint(req.headers.Get("X-Seq"), 10, 64)
+	if err != nil {
+		slog.Debug("bad request", "reason", "invalid packet sequence number", "addr", req.addr)
+		return req.resp.writeStatus(http.StatusBadRequest)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.body, MAX_PACKET_SIZE+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MAX_PACKET_SIZE {
+		slog.Debug("bad request", "reason", "packet too large", "addr", req.addr)
+		return req.resp.writeStatus(http.StatusRequestEntityTooLarge)
+	}
+
+	sess.Lock()
+	if sess.up == nil {
+		sess.up = sess.packets
+	}
+	sess.timeActive = time.Now().Unix()
+	sess.startIfReady()
+	sess.Unlock()
+
+	err = sess.packets.push(seq, data)
+	if err != nil {
+		// the session has ended
+		return req.resp.writeStatus(http.StatusGone)
+	}
+
+	return req.resp.writeFull(http.StatusOK, nil)
+}
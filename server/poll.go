@@ -0,0 +1,178 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// a poll without download data to return is answered after this long
+const POLL_HOLD = 10 * time.Second
+
+// the largest body of a poll response
+const MAX_POLL_SIZE = 1024 * 1024
+
+// data from remote waits while this many bytes are buffered for polls
+const POLL_BUFFER_SIZE = 4 * 1024 * 1024
+
+// a started session is removed if it has not been polled for this many
+// seconds
+const POLL_TIMEOUT = 60
+
+var errPollCursor = errors.New("invalid poll cursor")
+
+// pollBuffer keeps the download stream of a session between polls
+//
+// the cursor of a poll is the number of bytes the client has received, data
+// before it is dropped. A poll which is answered but lost is sent again with
+// the same cursor and gets the same data.
+type pollBuffer struct {
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced when buf or closed changes
+	base    uint64        // offset of buf[0] in the download stream
+	buf     []byte        // data not yet acknowledged by the client
+	closed  bool          // the download stream has ended
+}
+
+func newPollBuffer() *pollBuffer {
+	return &pollBuffer{
+		changed: make(chan struct{}),
+	}
+}
+
+// wake up waiting writes and polls
+//
+// b.mu must be held
+func (b *pollBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Write appends p to the download stream, it blocks while the buffer is full
+func (b *pollBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for !b.closed && len(b.buf) >= POLL_BUFFER_SIZE {
+		ch := b.changed
+		b.mu.Unlock()
+		<-ch
+		b.mu.Lock()
+	}
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	b.buf = append(b.buf, p...)
+	b.notify()
+	return len(p), nil
+}
+
+// Close ends the download stream, buffered data can still be polled
+func (b *pollBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		b.notify()
+	}
+	return nil
+}
+
+// return the data after cursor, waiting up to hold if there is none yet
+//
+// io.EOF is returned once the stream has ended and the client has received
+// all data
+func (b *pollBuffer) poll(cursor uint64, hold time.Duration) ([]byte, error) {
+	timer := time.NewTimer(hold)
+	defer timer.Stop()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		if cursor < b.base || cursor > b.base+uint64(len(b.buf)) {
+			return nil, errPollCursor
+		}
+
+		if cursor > b.base {
+			// the client has everything before cursor
+			b.buf = b.buf[cursor-b.base:]
+			b.base = cursor
+			if len(b.buf) == 0 {
+				b.buf = nil
+			}
+			b.notify()
+		}
+
+		if len(b.buf) > 0 {
+			return b.buf[:min(len(b.buf), MAX_POLL_SIZE)], nil
+		}
+
+		if b.closed {
+			return nil, io.EOF
+		}
+
+		ch := b.changed
+		b.mu.Unlock()
+		select {
+		case <-ch:
+			b.mu.Lock()
+		case <-timer.C:
+			b.mu.Lock()
+			return nil, nil
+		}
+	}
+}
+
+// handle a poll of the download stream of a session
+//
+// the session is removed after the poll which finds the stream ended. The
+// first poll is answered at once, so the client knows the session was
+// accepted.
+func (s *Server) handlePoll(req *request, sess *session) error {
+	cursor, err := strconv.ParseUint(req.headers.Get("X-Cursor"), 10, 64)
+	if err != nil {
+		slog.Debug("bad request", "reason", "invalid poll cursor", "addr", req.addr)
+		return req.resp.writeStatus(http.StatusBadRequest)
+	}
+
+	hold := POLL_HOLD
+
+	sess.Lock()
+	if sess.down == nil {
+		sess.down = sess.polls
+		sess.timeActive = time.Now().Unix()
+		sess.startIfReady()
+		hold = 0
+	}
+	sess.timePolled = time.Now().Unix()
+	sess.Unlock()
+
+	data, err := sess.polls.poll(cursor, hold)
+
+	sess.Lock()
+	sess.timePolled = time.Now().Unix()
+	sess.Unlock()
+
+	if errors.Is(err, io.EOF) {
+		slog.Debug("download polls end", "sessionId", sess.sessionId)
+
+		// remove the session from the map
+		s.sessions.CompareAndDelete(sess.sessionId, sess)
+
+		return req.resp.writeStatus(http.StatusGone)
+	}
+	if err != nil {
+		slog.Debug("conflict", "reason", "invalid poll cursor", "cursor", cursor, "sessionId", sess.sessionId, "addr", req.addr)
+		return req.resp.writeStatus(http.StatusConflict)
+	}
+
+	return req.resp.writeFull(http.StatusOK, data)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"math"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the state of the limits of one client address
+type addrLimit struct {
+	tokens   float64   // requests which may be sent at once
+	updated  time.Time // when tokens was last refilled
+	sessions int       // sessions being counted
+}
+
+// per address limits of requests and concurrent sessions
+type rateLimiter struct {
+	mu    sync.Mutex
+	addrs map[netip.Addr]*addrLimit
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		addrs: make(map[netip.Addr]*addrLimit),
+	}
+}
+
+// the burst of a rate, when none is configured
+func defaultBurst(rate float64) int {
+	return max(1, int(math.Ceil(rate)))
+}
+
+// the entry of addr, refilled until now
+//
+// l.mu must be held
+func (l *rateLimiter) get(addr netip.Addr, rate float64, burst int, now time.Time) *addrLimit {
+	a, ok := l.addrs[addr]
+	if !ok {
+		a = &addrLimit{tokens: float64(burst), updated: now}
+		l.addrs[addr] = a
+		return a
+	}
+
+	if rate > 0 {
+		a.tokens = min(float64(burst), a.tokens+now.Sub(a.updated).Seconds()*rate)
+	}
+	a.updated = now
+	return a
+}
+
+// take a token of addr for a request, rate is in requests per second
+func (l *rateLimiter) allowRequest(addr netip.Addr, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a := l.get(addr, rate, burst, time.Now())
+	if a.tokens < 1 {
+		return false
+	}
+	a.tokens--
+	return true
+}
+
+// count a new session of addr, unless it has max sessions already
+//
+// a counted session must be released
+func (l *rateLimiter) acquireSession(addr netip.Addr, max int) bool {
+	if max <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.addrs[addr]
+	if !ok {
+		a = &addrLimit{tokens: math.Inf(1), updated: time.Now()}
+		l.addrs[addr] = a
+	}
+	if a.sessions >= max {
+		return false
+	}
+	a.sessions++
+	return true
+}
+
+func (l *rateLimiter) releaseSession(addr netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if a, ok := l.addrs[addr]; ok {
+		a.sessions--
+	}
+}
+
+// forget the addresses without sessions whose tokens are refilled, they
+// would start again from a full bucket
+func (l *rateLimiter) prune(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for addr, a := range l.addrs {
+		if a.sessions > 0 {
+			continue
+		}
+		if rate > 0 && a.tokens+now.Sub(a.updated).Seconds()*rate < float64(burst) {
+			continue
+		}
+		delete(l.addrs, addr)
+	}
+}
+
+// the address of the client of req, taken from the header forwarded if it
+// is set and present and req was received from a trusted proxy, or the
+// address the request was received from
+//
+// of a list of addresses in the header, such as X-Forwarded-For, the last
+// one was added by the proxy in front of the server
+func clientAddr(req *request, forwarded string, trusted []netip.Prefix) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(req.addr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	peer := addrPort.Addr().Unmap()
+
+	if values := req.headers.Values(forwarded); forwarded != "" && len(values) > 0 && isTrusted(peer, trusted) {
+		list := strings.Split(values[len(values)-1], ",")
+		addr, err := netip.ParseAddr(strings.TrimSpace(list[len(list)-1]))
+		if err == nil {
+			return addr.Unmap(), true
+		}
+	}
+
+	return peer, true
+}
+
+// whether addr is in one of the prefixes of trusted
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
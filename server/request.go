@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"commonweb2/metrics"
+	"commonweb2/websocket"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// an upload or download request, received over http/1.1, http/2 or http/3
+type request struct {
+	method  string
+	headers textproto.MIMEHeader
+	body    io.Reader // request body, without http chunked encoding
+	addr    string    // address of the client or proxy
+	resp    responder
+
+	// finish the handshake of a websocket upgrade request, nil if the
+	// request is not an upgrade
+	websocket func() (*websocket.Conn, error)
+
+	// serve the request with the decoy of the server
+	decoy func() error
+}
+
+// tunnel responses are different for every request, caches in between must
+// not store or share them
+const CACHE_CONTROL = "no-store, private"
+
+// responder writes the response of a request
+type responder interface {
+	// write a response without body
+	writeStatus(code int) error
+
+	// write a complete response after the request body has been read, the
+	// connection may carry another request
+	writeFull(code int, body []byte) error
+
+	// write the header of a streaming response, each write to the returned
+	// writer is sent to the client at once
+	startStream() (io.Writer, error)
+
+	// end the streaming response
+	endStream() error
+
+	// abort the request, pending reads of the request body and writes to
+	// the response fail
+	abort()
+}
+
+// responder of a request received over http/1.1, the connection is closed
+// after the response unless it is written by writeFull
+type http1Responder struct {
+	s         *Server
+	conn      net.Conn
+	keepAlive bool // the client accepts another request on the connection
+	reusable  bool // the connection can read the next request
+}
+
+func (r *http1Responder) writeStatus(code int) error {
+	return r.s.writeResponse(code, r.conn)
+}
+
+func (r *http1Responder) writeFull(code int, body []byte) error {
+	metrics.ServerResponses.Inc(strconv.Itoa(code))
+
+	resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	resp += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+	resp += "Content-Type: application/octet-stream\r\n"
+	resp += "Cache-Control: " + CACHE_CONTROL + "\r\n"
+	if !r.keepAlive {
+		resp += "Connection: close\r\n"
+	}
+	resp += "\r\n"
+
+	_, err := r.conn.Write(append([]byte(resp), body...))
+	if err != nil {
+		return err
+	}
+
+	r.reusable = r.keepAlive
+	return nil
+}
+
+func (r *http1Responder) startStream() (io.Writer, error) {
+	metrics.ServerResponses.Inc(strconv.Itoa(http.StatusOK))
+
+	resp := "HTTP/1.1 200 OK\r\n"
+	resp += "Transfer-Encoding: chunked\r\n"
+	resp += "Content-Type: application/octet-stream\r\n"
+	resp += "Cache-Control: " + CACHE_CONTROL + "\r\n"
+	resp += "Connection: close\r\n"
+	resp += "\r\n"
+	_, err := r.conn.Write([]byte(resp))
+	if err != nil {
+		return nil, err
+	}
+
+	return httputil.NewChunkedWriter(r.conn), nil
+}
+
+func (r *http1Responder) endStream() error {
+	// https://www.rfc-editor.org/rfc/rfc9112#section-7.1
+	// sending an empty chunk to close the stream
+	_, err := r.conn.Write([]byte("0\r\n\r\n"))
+	return err
+}
+
+func (r *http1Responder) abort() {
+	r.conn.Close()
+}
+
+// handle a request received by a net/http based server (http/2, http/3, or
+// any protocol when mounted with Handler)
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	headers := textproto.MIMEHeader(r.Header)
+
+	req := &request{
+		method:  r.Method,
+		headers: headers,
+		body:    r.Body,
+		addr:    r.RemoteAddr,
+		resp:    &httpResponder{w: w, body: r.Body},
+	}
+	req.decoy = func() error {
+		s.serveDecoy(w, r)
+		return nil
+	}
+
+	if r.ProtoMajor == 1 {
+		// the download of a session may be written while its upload is read
+		http.NewResponseController(w).EnableFullDuplex()
+
+		if websocket.IsUpgrade(headers) {
+			req.websocket = func() (*websocket.Conn, error) {
+				err := websocket.CheckUpgrade(headers)
+				if err != nil {
+					return nil, err
+				}
+
+				conn, rw, err := http.NewResponseController(w).Hijack()
+				if err != nil {
+					return nil, fmt.Errorf("hijack: %w", err)
+				}
+
+				ws, err := websocket.Accept(conn, rw.Reader, headers)
+				if err != nil {
+					conn.Close()
+				}
+				return ws, err
+			}
+		}
+	}
+
+	err := s.handleRequest(req)
+	if err != nil {
+		slog.Error("handle request", "error", err, "addr", r.RemoteAddr)
+	}
+}
+
+// Handler returns an http.Handler serving the upload and download requests of
+// sessions, to be mounted at any path of an existing net/http server. Its
+// sessions are paired with the requests received by Start, which does not
+// need to be running.
+func (s *Server) Handler() http.Handler {
+	s.startSweeper()
+	return http.HandlerFunc(s.serveHTTP)
+}
+
+// responder of a request received by a net/http based server
+type httpResponder struct {
+	w    http.ResponseWriter
+	body io.Closer
+
+	// the response writer must not be used after the handler returns,
+	// done is set by endStream
+	mu   sync.Mutex
+	done bool
+}
+
+func (r *httpResponder) writeStatus(code int) error {
+	metrics.ServerResponses.Inc(strconv.Itoa(code))
+
+	r.w.Header().Set("Content-Length", "0")
+	r.w.Header().Set("Cache-Control", CACHE_CONTROL)
+	r.w.WriteHeader(code)
+	return nil
+}
+
+func (r *httpResponder) writeFull(code int, body []byte) error {
+	metrics.ServerResponses.Inc(strconv.Itoa(code))
+
+	r.w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	r.w.Header().Set("Content-Type", "application/octet-stream")
+	r.w.Header().Set("Cache-Control", CACHE_CONTROL)
+	r.w.WriteHeader(code)
+
+	_, err := r.w.Write(body)
+	return err
+}
+
+func (r *httpResponder) startStream() (io.Writer, error) {
+	metrics.ServerResponses.Inc(strconv.Itoa(http.StatusOK))
+
+	r.w.Header().Set("Content-Type", "application/octet-stream")
+	r.w.Header().Set("Cache-Control", CACHE_CONTROL)
+	r.w.WriteHeader(http.StatusOK)
+
+	err := http.NewResponseController(r.w).Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// write p and send it at once
+func (r *httpResponder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, err := r.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, http.NewResponseController(r.w).Flush()
+}
+
+func (r *httpResponder) endStream() error {
+	r.mu.Lock()
+	r.done = true
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *httpResponder) abort() {
+	r.body.Close()
+	r.endStream()
+}
+
+// a connection whose first bytes were read into a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// a reader keeping the bytes read through it while recording, so that the
+// decoy can read a request again from its first byte
+type replayReader struct {
+	r         io.Reader
+	recorded  []byte
+	recording bool
+}
+
+func (r *replayReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if r.recording {
+		r.recorded = append(r.recorded, b[:n]...)
+	}
+	return n, err
+}
+
+// record a new request, whose first bytes were read already
+func (r *replayReader) start(buffered []byte) {
+	r.recorded = append(r.recorded[:0], buffered...)
+	r.recording = true
+}
+
+// stop recording once the head of the request has been read, the body is
+// read after the decoy could be chosen
+func (r *replayReader) stop() {
+	r.recording = false
+}
+
+// the request from its first byte, followed by the rest of r
+func (r *replayReader) replay() io.Reader {
+	return io.MultiReader(bytes.NewReader(r.recorded), r.r)
+}
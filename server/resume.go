@@ -0,0 +1,171 @@
+package server
+
+import (
+	"commonweb2/datagram"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// copy data between remote and the resumable endpoint of the session
+//
+// unlike copyUp and copyDown, the session is not closed when one direction
+// ends. The end of the stream is sent to the client and the session is
+// closed once the client has acknowledged it.
+func (s *session) copyResumable(conn net.Conn) {
+	defer conn.Close()
+
+	// remote -> endpoint
+	go func() {
+		defer s.ep.CloseWrite()
+
+		if s.network == "udp" {
+			buf := make([]byte, datagram.MAX_LENGTH)
+			frame := make([]byte, 0, datagram.HEADER_LENGTH+datagram.MAX_LENGTH)
+
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+
+				_, err = s.ep.Write(datagram.Append(frame[:0], buf[:n]))
+				if err != nil {
+					return
+				}
+			}
+		}
+
+		io.Copy(s.ep, conn)
+	}()
+
+	// endpoint -> remote
+	go func() {
+		defer conn.Close()
+
+		if s.network == "udp" {
+			buf := make([]byte, datagram.MAX_LENGTH)
+
+			for {
+				n, err := datagram.Read(s.ep, buf)
+				if err != nil {
+					return
+				}
+
+				_, err = conn.Write(buf[:n])
+				if err != nil {
+					slog.Debug("write datagram", "sessionId", s.sessionId, "error", err)
+				}
+			}
+		}
+
+		io.Copy(conn, s.ep)
+	}()
+
+	select {
+	case <-s.ep.Done():
+		slog.Debug("session closed", "sessionId", s.sessionId, "cause", "stream ended")
+	case <-s.ch:
+	}
+
+	s.close()
+}
+
+// handle upload connection of a resumable session
+//
+// a new upload connection replaces the previous one, and the client resends
+// any data the server has not acknowledged
+func (s *Server) handleResumableUpload(reader io.Reader, resp responder, sess *session) error {
+	sess.Lock()
+	if sess.upClose != nil {
+		slog.Debug("upload connection replaced", "sessionId", sess.sessionId)
+		sess.upClose()
+	}
+	sess.upGen++
+	gen := sess.upGen
+	sess.up = reader
+	sess.upClose = resp.abort
+	sess.timeActive = time.Now().Unix()
+	sess.startIfReady()
+	sess.Unlock()
+
+	err := sess.ep.ServeReceive(reader)
+
+	sess.Lock()
+	if sess.upGen == gen {
+		sess.up = nil
+		sess.upClose = nil
+		sess.timeDetached = time.Now().Unix()
+	}
+	sess.Unlock()
+
+	if !sess.ep.IsDone() && !sess.isClosed() {
+		slog.Warn("upload connection lost", "sessionId", sess.sessionId, "error", err)
+		return nil
+	}
+
+	<-sess.ch // waiting the session to end
+	slog.Debug("upload connection ends", "sessionId", sess.sessionId)
+
+	// remove the session from the map
+	s.sessions.Delete(sess.sessionId)
+
+	return resp.writeStatus(http.StatusOK)
+}
+
+// handle download connection of a resumable session
+//
+// offset is the number of bytes the client has received, data before offset
+// is acknowledged and the rest is sent again
+func (s *Server) handleResumableDownload(resp responder, sess *session, offset uint64) error {
+	down, err := resp.startStream()
+	if err != nil {
+		return err
+	}
+
+	sess.ep.Ack(offset)
+
+	sess.Lock()
+	if sess.downClose != nil {
+		slog.Debug("download connection replaced", "sessionId", sess.sessionId)
+		sess.downClose()
+	}
+	sess.downGen++
+	gen := sess.downGen
+	sess.down = down
+	sess.downClose = resp.abort
+	sess.timeActive = time.Now().Unix()
+	sess.startIfReady()
+	sess.Unlock()
+
+	err = sess.ep.ServeSend(down)
+
+	sess.Lock()
+	if sess.downGen == gen {
+		sess.down = nil
+		sess.downClose = nil
+		sess.timeDetached = time.Now().Unix()
+	}
+	sess.Unlock()
+
+	if err != nil && !sess.isClosed() {
+		slog.Warn("download connection lost", "sessionId", sess.sessionId, "error", err)
+		return nil
+	}
+
+	<-sess.ch // waiting the session to end
+
+	err = resp.endStream()
+	if err != nil {
+		slog.Error("download connection end stream", "err", err)
+	}
+
+	slog.Debug("download connection ends", "sessionId", sess.sessionId)
+
+	// remove the session from the map
+	s.sessions.Delete(sess.sessionId)
+
+	return nil
+}
@@ -2,34 +2,245 @@ package server
 
 import (
 	"bufio"
+	"commonweb2/auth"
+	"commonweb2/datagram"
+	"commonweb2/metrics"
+	"commonweb2/resume"
+	"commonweb2/websocket"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/netip"
 	"net/textproto"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
 )
 
 const SESSION_TIMEOUT = 10
 
-type server struct {
+// idle connections are closed after this long, when they may carry another
+// request
+const KEEP_ALIVE_TIMEOUT = 60 * time.Second
+
+// resumable sessions are kept for this long after losing a connection,
+// if no grace period is configured
+const RESUME_GRACE = 30 * time.Second
+
+// how often Shutdown checks whether every session has ended
+const SHUTDOWN_POLL_INTERVAL = 100 * time.Millisecond
+
+type Options struct {
+	Listen string // listen address
+	Remote string // remote address, empty to hand sessions to Accept
+	Secret string // shared secret for authenticating requests, empty to disable
+
+	// named secrets accepted besides Secret, the sessions authenticated by
+	// one of them share its bandwidth limits
+	Credentials []Credential
+
+	// destinations requested by clients are checked against Allow,
+	// nil to refuse any destination other than Remote
+	Allow *Allowlist
+
+	// serves requests which are not tunnel requests, such as probes, nil to
+	// answer them with a bare status code. See NewDecoy.
+	Decoy http.Handler
+
+	// limits per client address, which is taken from ForwardedHeader if it
+	// is set, e.g. X-Forwarded-For behind a proxy, and the request was
+	// received from one of TrustedProxies. Requests over the limits are
+	// answered with 429, or by the decoy.
+	RateLimit       float64 // requests per second, 0 for no limit
+	RateBurst       int     // requests which may be sent at once, RateLimit rounded up if 0
+	MaxSessions     int     // concurrent sessions, 0 for no limit
+	ForwardedHeader string
+	TrustedProxies  []netip.Prefix
+
+	// bandwidth of all sessions, of each session, and of the sessions of
+	// each client address, told apart like the rate limits. Reload changes
+	// the limits of existing sessions too.
+	Bandwidth        Bandwidth
+	SessionBandwidth Bandwidth
+	ClientBandwidth  Bandwidth
+
+	// how long a resumable session is kept after losing its upload or
+	// download connection
+	ResumeGrace time.Duration
+
+	// accept http/3 on this udp address, empty to disable. http/3 requires
+	// a tls certificate and its private key.
+	H3Listen string
+	CertFile string
+	KeyFile  string
+
+	// terminate tls on the tcp listener with CertFile and KeyFile, which are
+	// loaded again when they change
+	TLS bool
+
+	// obtain and renew the certificates of these domains from an acme
+	// certificate authority, instead of using CertFile and KeyFile. tls is
+	// terminated on the tcp listener, which also answers http-01 challenges
+	// received over plain http.
+	ACMEDomains   []string
+	ACMECacheDir  string // keeps the certificates and the account key, required
+	ACMEEmail     string // contact address of the account, optional
+	ACMEDirectory string // directory url of the authority, empty for let's encrypt
+	ACMECAFile    string // certificates trusted for the directory url, empty for the system roots
+}
+
+// Server accepts sessions of clients and connects them to remote, or hands
+// them to Accept. It can be used as a net.Listener.
+type Server struct {
 	listen   string
-	remote   string
+	settings atomic.Pointer[settings] // settings of new sessions
+	h3Listen string
+	certFile string
+	keyFile  string
+	tls      bool
+	cert     *certificate      // nil if neither tls nor http/3 is enabled, or acme is used
+	acmeOpts Options           // the acme options the server was created with
+	acme     *autocert.Manager // nil if acme is disabled
+	plain    *connListener     // plain http connections carrying challenges, if acme is enabled
+	decoys   *connListener     // http/1.1 connections served by the decoy
 	sessions sync.Map
-	listener net.Listener
+	h3       *http3.Server // nil if http/3 is disabled
+	h3Conn   net.PacketConn
+
+	// remove the sessions of the server from the session gauges
+	removeGauges []func()
+
+	accepted chan net.Conn // sessions waiting for Accept
+
+	limits *rateLimiter // per client address
+
+	bandwidth   limiterPair                    // of all sessions
+	clients     map[netip.Addr]*sharedLimiters // of the client addresses with sessions
+	credentials map[string]*sharedLimiters     // of the credentials with sessions, by name
+	clientsMu   sync.Mutex
+
+	// closed by stopListening, Start does not listen once closing is set
+	listener   net.Listener
+	listenerMu sync.Mutex
+
+	// shutdown
+	closing     atomic.Bool           // new sessions are refused
+	requests    atomic.Int64          // requests being handled
+	conns       map[net.Conn]struct{} // connections being served
+	connsMu     sync.Mutex
+	wg          sync.WaitGroup // goroutines serving connections, and the sweeper
+	done        chan struct{}  // closed to stop the sweeper
+	doneOnce    sync.Once
+	sweeperOnce sync.Once
+}
+
+// the options of a server which can be changed by Reload, a session keeps
+// the settings it was created with
+type settings struct {
+	remote      string
+	secret      string
+	credentials []Credential
+	allow       *Allowlist
+	grace       time.Duration
+	decoy       http.Handler
+
+	rate        float64
+	burst       int
+	maxSessions int
+	forwarded   string
+	trusted     []netip.Prefix
+
+	bandwidth        Bandwidth
+	sessionBandwidth Bandwidth
+	clientBandwidth  Bandwidth
+}
+
+func newSettings(opts Options) *settings {
+	grace := opts.ResumeGrace
+	if grace <= 0 {
+		grace = RESUME_GRACE
+	}
+
+	burst := opts.RateBurst
+	if burst <= 0 {
+		burst = defaultBurst(opts.RateLimit)
+	}
+
+	return &settings{
+		remote:      opts.Remote,
+		secret:      opts.Secret,
+		credentials: opts.Credentials,
+		allow:       opts.Allow,
+		grace:       grace,
+		decoy:       opts.Decoy,
+
+		rate:        opts.RateLimit,
+		burst:       burst,
+		maxSessions: opts.MaxSessions,
+		forwarded:   opts.ForwardedHeader,
+		trusted:     opts.TrustedProxies,
+
+		bandwidth:        opts.Bandwidth,
+		sessionBandwidth: opts.SessionBandwidth,
+		clientBandwidth:  opts.ClientBandwidth,
+	}
 }
 
 type session struct {
-	sessionId  string
-	up         io.Reader // upload connection
-	down       io.Writer // download connection
-	ch         chan struct{}
-	timeActive int64     // timestamp when a up/down connection is connected
-	closeOnce  sync.Once // prevent closing ch multiple times
+	sessionId   string
+	settings    *settings
+	destination string        // destination requested by the client, empty for remote
+	network     string        // tcp / udp
+	mux         bool          // the session carries multiplexed streams
+	packets     *packetBuffer // reorders upload packets, nil if the upload is streamed
+	polls       *pollBuffer   // keeps download data between polls, nil if the download is streamed
+	up          io.Reader     // upload stream, without http chunked encoding
+	down        io.Writer     // download stream, each write is sent as one http chunk
+	ch          chan struct{}
+	timeActive  int64     // timestamp when a up/down connection is connected
+	timePolled  int64     // timestamp of the last poll of the download stream
+	closeOnce   sync.Once // prevent closing ch multiple times
+	started     bool      // copy has been started
+	created     time.Time
+	release     []func()      // called when the session is closed, giving back its share of the limits
+	bandwidth   limiterPair   // limits of the session alone
+	shared      []limiterPair // limits shared with other sessions, of the server and the client address
+	upAddr      string        // address of the last upload request
+	downAddr    string        // address of the last download request
+	bytesUp     atomic.Uint64 // bytes sent to remote
+	bytesDown   atomic.Uint64 // bytes received from remote
+
+	// connect to remote or a destination, sessions with an empty address
+	// are handed to Accept
+	dial func(network string, address string) (net.Conn, error)
+
+	// sessions which are not multiplexed, connected by connect
+	connectOnce sync.Once
+	conn        net.Conn
+	connectErr  error
+
+	// resumable sessions only
+	ep           *resume.Endpoint // nil if the session is not resumable
+	upGen        int              // incremented when the upload connection is replaced
+	downGen      int              // incremented when the download connection is replaced
+	upClose      func()           // close the current upload connection
+	downClose    func()           // close the current download connection
+	timeDetached int64            // timestamp when a up/down connection is lost
+
 	sync.Mutex
 }
 
@@ -37,129 +248,240 @@ type session struct {
 func (s *session) close() {
 	s.closeOnce.Do(func() {
 		close(s.ch)
+		for _, release := range s.release {
+			release()
+		}
+		if s.ep != nil {
+			s.ep.Close()
+		}
+		if s.packets != nil {
+			s.packets.Close()
+		}
+		if s.polls != nil {
+			s.polls.Close()
+		}
 	})
 }
 
-// connect to remote and copy data
-func (s *session) copy(remote string) {
+// check whether s.ch is closed
+func (s *session) isClosed() bool {
+	select {
+	case <-s.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// start copying data if both connections are present
+//
+// s.Mutex must be held
+func (s *session) startIfReady() {
+	ready := s.up != nil && s.down != nil
+
+	if ready && !s.started {
+		s.started = true
+		slog.Info("session ready", "sessionId", s.sessionId)
+		go s.copy(s.settings.remote, s.settings.allow)
+	}
+}
+
+// connect to remote, or the destination requested by the client, and copy data
+func (s *session) copy(remote string, allow *Allowlist) {
+
+	if s.mux {
+		// each stream connects to its own destination
+		s.copyMux(remote, allow)
+		return
+	}
 
-	conn, err := net.Dial("tcp", remote)
+	conn, err := s.connect()
 	if err != nil {
 		s.close()
 		slog.Error("dial remote", "error", err)
 		return
 	}
+	conn = s.limitConn(s.countConn(conn))
+
+	if s.ep != nil {
+		go s.copyResumable(conn)
+	} else if s.network == "udp" {
+		go s.copyUDPUp(conn)
+		go s.copyUDPDown(conn)
+	} else {
+		go s.copyUp(conn)
+		go s.copyDown(conn)
+	}
 
-	// up conn -> remote
-	go func() {
-		defer s.close()
-		defer conn.Close()
-		defer slog.Debug("session closed", "sessionId", s.sessionId, "cause", "up -> remote")
-
-		for {
+	<-s.ch
+}
 
-			// http chunked transfer
-			reader := s.up.(*bufio.Reader)
-			line, _, err := reader.ReadLine()
-			if err != nil {
-				return
-			}
-			length, err := strconv.ParseUint(string(line), 16, 32)
+// the destination is not allowed by the allowlist
+var errNotAllowed = errors.New("destination not allowed")
+
+// resolve and connect to the destination of the session, or remote, once
+//
+// sessions are connected before their requests are answered, so the client
+// learns whether the destination was reached
+func (s *session) connect() (net.Conn, error) {
+	s.connectOnce.Do(func() {
+		addr := s.settings.remote
+		if s.destination != "" {
+			var err error
+			addr, err = s.settings.allow.resolve(s.destination)
 			if err != nil {
+				s.connectErr = fmt.Errorf("%w: %w", errNotAllowed, err)
 				return
 			}
+		}
 
-			if length == 0 {
-				// zero length indicating end of stream
-				return
-			}
+		conn, err := s.dial(s.network, addr)
+		if err != nil {
+			metrics.ServerDialFailures.Inc()
+			s.connectErr = err
+			return
+		}
+		s.conn = conn
 
-			_, err = io.CopyN(conn, reader, int64(length))
-			if err != nil {
-				return
-			}
+		// the session may end before it is paired and copied
+		go func() {
+			<-s.ch
+			conn.Close()
+		}()
+	})
 
-			_, _, err = reader.ReadLine()
-			if err != nil {
-				return
-			}
-		}
-	}()
+	return s.conn, s.connectErr
+}
 
-	// remote -> down conn
-	go func() {
-		defer s.close()
-		defer conn.Close()
-		defer slog.Debug("session closed", "sessionId", s.sessionId, "cause", "remote -> down")
+// up conn -> remote
+func (s *session) copyUp(conn net.Conn) {
+	defer s.close()
+	defer conn.Close()
+	defer slog.Debug("session closed", "sessionId", s.sessionId, "cause", "up -> remote")
 
-		buf := make([]byte, 2048)
+	io.Copy(conn, s.up)
+}
 
-		for {
-			n, err := conn.Read(buf)
-			if err != nil {
-				return
-			}
+// remote -> down conn
+func (s *session) copyDown(conn net.Conn) {
+	defer s.close()
+	defer conn.Close()
+	defer slog.Debug("session closed", "sessionId", s.sessionId, "cause", "remote -> down")
 
-			// http chunked transfer
-			// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Transfer-Encoding#directives
+	buf := make([]byte, 2048)
 
-			if n == 2048 { // sprintf could be time consuming
-				_, err = s.down.Write([]byte("800\r\n"))
-			} else {
-				_, err = s.down.Write([]byte(fmt.Sprintf("%x\r\n", n)))
-			}
-			if err != nil {
-				return
-			}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
 
-			_, err = s.down.Write(buf[:n])
-			if err != nil {
-				return
-			}
+		// each write is sent as one http chunk
+		_, err = s.down.Write(buf[:n])
+		if err != nil {
+			return
+		}
+	}
+}
 
-			_, err = s.down.Write([]byte("\r\n"))
-			if err != nil {
-				return
-			}
+// up conn -> remote, one datagram per frame
+func (s *session) copyUDPUp(conn net.Conn) {
+	defer s.close()
+	defer conn.Close()
+	defer slog.Debug("session closed", "sessionId", s.sessionId, "cause", "up -> remote")
+
+	buf := make([]byte, datagram.MAX_LENGTH)
 
+	for {
+		n, err := datagram.Read(s.up, buf)
+		if err != nil {
+			return
+		}
+
+		_, err = conn.Write(buf[:n])
+		if err != nil {
+			slog.Debug("write datagram", "sessionId", s.sessionId, "error", err)
 		}
+	}
+}
 
-	}()
+// remote -> down conn, one frame per datagram
+func (s *session) copyUDPDown(conn net.Conn) {
+	defer s.close()
+	defer conn.Close()
+	defer slog.Debug("session closed", "sessionId", s.sessionId, "cause", "remote -> down")
 
-	<-s.ch
+	buf := make([]byte, datagram.MAX_LENGTH)
+	frame := make([]byte, 0, datagram.HEADER_LENGTH+datagram.MAX_LENGTH)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		_, err = s.down.Write(datagram.Append(frame[:0], buf[:n]))
+		if err != nil {
+			return
+		}
+	}
 }
 
-func (s *server) Start() error {
+func (s *Server) Start() error {
 	l, err := net.Listen("tcp", s.listen)
 	if err != nil {
 		return err
 	}
 
-	s.listener = l
-
-	// session timeout
-	go func() {
-		for {
-			s.sessions.Range(func(key, value any) bool {
-				sess := value.(*session)
+	if len(s.acmeOpts.ACMEDomains) > 0 {
+		s.acme, err = newACMEManager(s.acmeOpts)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		slog.Info("acme enabled", "addr", s.listen, "domains", s.acmeOpts.ACMEDomains)
+	} else if s.tls || s.h3Listen != "" {
+		if s.certFile == "" || s.keyFile == "" {
+			l.Close()
+			return fmt.Errorf("tls and http/3 require a certificate and a key")
+		}
 
-				sess.Lock()
+		s.cert, err = loadCertificate(s.certFile, s.keyFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+	}
 
-				ready := sess.up != nil && sess.down != nil
+	if s.tls && s.acme == nil {
+		slog.Info("tls enabled", "addr", s.listen)
+		l = tls.NewListener(l, s.tlsConfig())
+	}
 
-				if !ready && time.Now().Unix()-sess.timeActive > SESSION_TIMEOUT && sess.timeActive != 0 {
-					slog.Warn("session timeout", "sessionId", sess.sessionId)
-					sess.close()
-					s.sessions.Delete(key)
-				}
+	s.listenerMu.Lock()
+	if s.closing.Load() {
+		s.listenerMu.Unlock()
+		l.Close()
+		return fmt.Errorf("accept: %w", net.ErrClosed)
+	}
+	s.listener = l
+	s.listenerMu.Unlock()
 
-				sess.Unlock()
+	if s.acme != nil {
+		// tls and plain http are told apart by handleConnection
+		s.startACME()
+	}
+	s.decoys = s.serveConns(http.HandlerFunc(s.serveDecoy))
 
-				return true
-			})
-			time.Sleep(time.Second * 5)
+	if s.h3Listen != "" {
+		err := s.startHTTP3()
+		if err != nil {
+			l.Close()
+			return err
 		}
-	}()
+	}
+
+	s.startSweeper()
 
 	for {
 		conn, err := l.Accept()
@@ -169,7 +491,14 @@ func (s *server) Start() error {
 
 		slog.Debug("new connection", "addr", conn.RemoteAddr())
 
+		s.connsMu.Lock()
+		s.conns[conn] = struct{}{}
+		s.connsMu.Unlock()
+
+		s.wg.Add(1)
 		go func() {
+			defer s.wg.Done()
+
 			err := s.handleConnection(conn)
 			if err != nil {
 				slog.Error("handle connection", "error", err)
@@ -177,88 +506,626 @@ func (s *server) Start() error {
 
 			slog.Info("connection ends", "addr", conn.RemoteAddr())
 			conn.Close()
+
+			s.connsMu.Lock()
+			delete(s.conns, conn)
+			s.connsMu.Unlock()
 		}()
 	}
 }
 
-func (s *server) Close() error {
-	return s.listener.Close()
+// register the gauges of the server and start closing sessions which time
+// out, once
+func (s *Server) startSweeper() {
+	s.sweeperOnce.Do(func() {
+		s.removeGauges = []func(){
+			metrics.ServerSessionsActive.Add(func() int64 {
+				active, _ := s.countSessions()
+				return active
+			}),
+			metrics.ServerSessionsUnpaired.Add(func() int64 {
+				_, unpaired := s.countSessions()
+				return unpaired
+			}),
+		}
+
+		s.wg.Add(1)
+		go s.sweep()
+	})
 }
 
-func (*server) writeResponse(code int, conn io.Writer) error {
-	status := http.StatusText(code)
-	_, err := conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, status)))
+// close sessions which time out, until the server is closed
+func (s *Server) sweep() {
+	defer s.wg.Done()
+
+	for {
+		s.sessions.Range(func(key, value any) bool {
+			sess := value.(*session)
+
+			sess.Lock()
+
+			ready := sess.up != nil && sess.down != nil
+
+			if !ready && time.Now().Unix()-sess.timeActive > SESSION_TIMEOUT && sess.timeActive != 0 && !sess.started {
+				slog.Warn("session timeout", "sessionId", sess.sessionId)
+				metrics.ServerSessionTimeouts.Inc("pair")
+				sess.close()
+				s.sessions.Delete(key)
+			}
+
+			// resumable session which lost a connection and was not resumed in time
+			if !ready && sess.started && sess.ep != nil && time.Now().Unix()-sess.timeDetached > int64(sess.settings.grace.Seconds()) {
+				slog.Warn("session resume timeout", "sessionId", sess.sessionId)
+				metrics.ServerSessionTimeouts.Inc("resume")
+				sess.close()
+				s.sessions.Delete(key)
+			}
+
+			// polled session which the client stopped polling
+			if sess.started && sess.polls != nil && time.Now().Unix()-sess.timePolled > POLL_TIMEOUT {
+				slog.Warn("session poll timeout", "sessionId", sess.sessionId)
+				metrics.ServerSessionTimeouts.Inc("poll")
+				sess.close()
+				s.sessions.Delete(key)
+			}
+
+			sess.Unlock()
+
+			return true
+		})
+
+		current := s.settings.Load()
+		s.limits.prune(current.rate, current.burst)
+
+		select {
+		case <-time.After(time.Second * 5):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// count the sessions whose connections are paired, and those waiting for
+// their upload or download connection
+func (s *Server) countSessions() (active int64, unpaired int64) {
+	s.sessions.Range(func(key, value any) bool {
+		sess := value.(*session)
+
+		sess.Lock()
+		if sess.started {
+			active++
+		} else {
+			unpaired++
+		}
+		sess.Unlock()
+
+		return true
+	})
+	return active, unpaired
+}
+
+// stop accepting connections and refuse new sessions
+func (s *Server) stopListening() error {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+
+	s.closing.Store(true)
+	if s.listener == nil {
+		return nil
+	}
+
+	err := s.listener.Close()
+	s.listener = nil
 	return err
 }
 
-// find or create a new session
-func (s *server) findSession(sessionId string) *session {
-	v, _ := s.sessions.LoadOrStore(sessionId, &session{
-		sessionId: sessionId,
-		ch:        make(chan struct{}),
+// close every session and connection, and stop the sweeper
+//
+// it returns the number of sessions which were closed
+func (s *Server) closeAll() int {
+	closed := 0
+	s.sessions.Range(func(key, value any) bool {
+		value.(*session).close()
+		s.sessions.Delete(key)
+		closed++
+		return true
 	})
 
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsMu.Unlock()
+
+	s.doneOnce.Do(func() {
+		// the sweeper can not be started once the server is closed
+		s.sweeperOnce.Do(func() {})
+		close(s.done)
+
+		for _, remove := range s.removeGauges {
+			remove()
+		}
+		if s.h3 != nil {
+			s.h3.Close()
+			s.h3Conn.Close()
+		}
+	})
+
+	return closed
+}
+
+// Shutdown stops accepting connections and new sessions, and waits for the
+// existing sessions to end. The sessions left when ctx is done are closed.
+//
+// it returns once every connection has been closed and the sweeper has
+// stopped
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stopListening()
+
+	ticker := time.NewTicker(SHUTDOWN_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	var ctxErr error
+	for ctxErr == nil && (s.requests.Load() > 0 || s.hasSessions()) {
+		select {
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	closed := s.closeAll()
+	s.wg.Wait()
+
+	if ctxErr != nil {
+		err = errors.Join(err, fmt.Errorf("%d sessions closed at the deadline: %w", closed, ctxErr))
+	}
+	return err
+}
+
+// check whether any session is left
+func (s *Server) hasSessions() bool {
+	found := false
+	s.sessions.Range(func(key, value any) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// Close closes the listeners, every session and every connection at once
+func (s *Server) Close() error {
+	err := s.stopListening()
+	s.closeAll()
+	s.wg.Wait()
+	return err
+}
+
+func (*Server) writeResponse(code int, conn io.Writer) error {
+	metrics.ServerResponses.Inc(strconv.Itoa(code))
+
+	status := http.StatusText(code)
+	_, err := conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\nCache-Control: %s\r\nConnection: close\r\n\r\n", code, status, CACHE_CONTROL)))
+	return err
+}
+
+// find the session with the id of sess, or store sess as a new session
+func (s *Server) findSession(sess *session) *session {
+	v, _ := s.sessions.LoadOrStore(sess.sessionId, sess)
+
 	return v.(*session)
 }
 
-func (s *server) handleConnection(conn net.Conn) error {
+func (s *Server) handleConnection(conn net.Conn) error {
+
+	// plain http on the listener of a server using acme, which may carry
+	// http-01 challenges
+	plain := false
 
-	conn.(*net.TCPConn).SetNoDelay(true)
+	if s.acme != nil {
+		acmeConn, err := s.acmeConn(conn)
+		if err != nil {
+			return err
+		}
+		conn = acmeConn
+		_, isTLS := conn.(*tls.Conn)
+		plain = !isTLS
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if tcpConn, ok := tlsConn.NetConn().(*net.TCPConn); ok {
+			tcpConn.SetNoDelay(true)
+		}
+
+		tlsConn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+		err := tlsConn.Handshake()
+		if err != nil {
+			return fmt.Errorf("tls handshake: %w", err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		switch tlsConn.ConnectionState().NegotiatedProtocol {
+		case "h2":
+			s.serveHTTP2(conn)
+			return nil
+		case acme.ALPNProto:
+			// a tls-alpn-01 challenge is answered by the handshake
+			return nil
+		}
+	} else if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+
+	replay := &replayReader{r: conn}
+	bufReader := bufio.NewReader(replay)
+
+	// http/2 with prior knowledge, sent by a proxy in front of the server.
+	// The preface is longer than some http/1.1 requests, it is only waited
+	// for after its method.
+	prefix, err := bufReader.Peek(len("PRI "))
+	if err == nil && string(prefix) == "PRI " {
+		preface, err := bufReader.Peek(len(http2.ClientPreface))
+		if err == nil && string(preface) == http2.ClientPreface {
+			s.serveHTTP2(&bufferedConn{Conn: conn, r: bufReader})
+			return nil
+		}
+	}
 
-	bufReader := bufio.NewReader(conn)
 	reader := textproto.NewReader(bufReader)
-	line, err := reader.ReadLine()
-	if err != nil {
-		return fmt.Errorf("readline: %w", err)
+
+	// the decoy reads the request again from its first byte, further
+	// requests on the connection are also served by the decoy
+	decoy := func() error {
+		s.decoys.handOff(&bufferedConn{Conn: conn, r: bufio.NewReader(replay.replay())})
+		return nil
 	}
 
-	// read http request
-	splites := strings.SplitN(line, " ", 3) // example: GET /file.txt HTTP/1.1
-	if len(splites) != 3 {
-		return s.writeResponse(http.StatusBadRequest, conn)
+	// answered by the acme manager the same way
+	challenge := func() error {
+		s.plain.handOff(&bufferedConn{Conn: conn, r: bufio.NewReader(replay.replay())})
+		return nil
 	}
-	method, _, version := splites[0], splites[1], splites[2]
-	if version != "HTTP/1.1" && version != "HTTP/1.0" {
-		return s.writeResponse(http.StatusHTTPVersionNotSupported, conn)
+
+	// answer a request which can not be parsed with code, or with the decoy
+	// if one is configured
+	reject := func(code int) error {
+		if s.settings.Load().decoy == nil {
+			return s.writeResponse(code, conn)
+		}
+		return decoy()
 	}
 
-	if method != http.MethodGet && method != http.MethodPost {
-		return s.writeResponse(http.StatusMethodNotAllowed, conn)
+	for {
+		buffered, _ := bufReader.Peek(bufReader.Buffered())
+		replay.start(buffered)
+
+		line, err := reader.ReadLine()
+		if err != nil {
+			return fmt.Errorf("readline: %w", err)
+		}
+
+		// read http request
+		splites := strings.SplitN(line, " ", 3) // example: GET /file.txt HTTP/1.1
+		if len(splites) != 3 {
+			return reject(http.StatusBadRequest)
+		}
+		method, version := splites[0], splites[2]
+		if version != "HTTP/1.1" && version != "HTTP/1.0" {
+			return reject(http.StatusHTTPVersionNotSupported)
+		}
+
+		headers, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return reject(http.StatusBadRequest)
+		}
+		if plain && isACMEChallenge(splites[1]) {
+			return challenge()
+		}
+		replay.stop()
+
+		// the streaming upload is chunked, upload packets have a length
+		var body io.Reader = http.NoBody
+		if strings.EqualFold(headers.Get("Transfer-Encoding"), "chunked") {
+			body = httputil.NewChunkedReader(bufReader)
+		} else if headers.Get("Content-Length") != "" {
+			length, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+			if err != nil || length < 0 {
+				return reject(http.StatusBadRequest)
+			}
+			body = io.LimitReader(bufReader, length)
+		}
+
+		resp := &http1Responder{
+			s:         s,
+			conn:      conn,
+			keepAlive: version == "HTTP/1.1" && !strings.EqualFold(headers.Get("Connection"), "close"),
+		}
+
+		req := &request{
+			method:  method,
+			headers: headers,
+			body:    body,
+			addr:    conn.RemoteAddr().String(),
+			resp:    resp,
+		}
+
+		if websocket.IsUpgrade(headers) {
+			req.websocket = func() (*websocket.Conn, error) {
+				return websocket.Accept(conn, bufReader, headers)
+			}
+		}
+
+		req.decoy = decoy
+
+		err = s.handleRequest(req)
+		if err != nil || !resp.reusable {
+			return err
+		}
+
+		// wait for the next request on the connection
+		conn.SetReadDeadline(time.Now().Add(KEEP_ALIVE_TIMEOUT))
+		_, err = bufReader.Peek(1)
+		if err != nil {
+			return nil
+		}
+		conn.SetReadDeadline(time.Time{})
 	}
+}
 
-	headers, err := reader.ReadMIMEHeader()
-	if err != nil {
-		return s.writeResponse(http.StatusBadRequest, conn)
+// handle an upload or download request
+func (s *Server) handleRequest(req *request) error {
+	method, headers, resp := req.method, req.headers, req.resp
+
+	s.requests.Add(1)
+	defer s.requests.Add(-1)
+
+	current := s.settings.Load()
+
+	// only requests which may create a session are charged, not the
+	// further requests of a known session, like each packet or poll
+	addr, limited := clientAddr(req, current.forwarded, current.trusted)
+	_, known := s.sessions.Load(headers.Get("X-Session-Id"))
+	if limited && !known && !s.limits.allowRequest(addr, current.rate, current.burst) {
+		slog.Debug("too many requests", "reason", "request rate", "client", addr, "addr", req.addr)
+		metrics.ServerRateLimited.Inc("requests")
+		return s.refuse(req, current, http.StatusTooManyRequests)
+	}
+
+	// requests which are not tunnel requests are passed to the decoy
+	if method != http.MethodGet && method != http.MethodPost {
+		return s.refuse(req, current, http.StatusMethodNotAllowed)
 	}
 
 	sessionId := headers.Get("X-Session-Id")
 	if sessionId == "" {
-		slog.Debug("bad request", "reason", "missing session id", "addr", conn.RemoteAddr())
-		return s.writeResponse(http.StatusBadRequest, conn)
+		slog.Debug("bad request", "reason", "missing session id", "addr", req.addr)
+		return s.refuse(req, current, http.StatusBadRequest)
 	}
 	if len(sessionId) > 16 {
-		slog.Debug("bad request", "reason", "session id too long", "addr", conn.RemoteAddr())
-		return s.writeResponse(http.StatusBadRequest, conn)
+		slog.Debug("bad request", "reason", "session id too long", "addr", req.addr)
+		return s.refuse(req, current, http.StatusBadRequest)
+	}
+
+	credential, err := s.authenticate(current, sessionId, headers.Get("X-Auth-Token"))
+	if err != nil {
+		slog.Debug("bad request", "reason", "invalid auth token", "error", err, "addr", req.addr)
+		return s.refuse(req, current, http.StatusBadRequest)
+	}
+
+	destination := headers.Get("X-Destination")
+	if destination != "" {
+		if current.allow == nil {
+			slog.Debug("forbidden", "reason", "destinations not allowed", "addr", req.addr)
+			return resp.writeStatus(http.StatusForbidden)
+		}
+
+		err := current.allow.checkPort(destination)
+		if err != nil {
+			slog.Debug("forbidden", "reason", "destination not allowed", "destination", destination, "error", err, "addr", req.addr)
+			return resp.writeStatus(http.StatusForbidden)
+		}
+	}
+
+	network := headers.Get("X-Network")
+	if network == "" {
+		network = "tcp"
+	}
+	if network != "tcp" && network != "udp" {
+		slog.Debug("bad request", "reason", "unknown network", "network", network, "addr", req.addr)
+		return resp.writeStatus(http.StatusBadRequest)
+	}
+
+	muxMode := headers.Get("X-Mux") == "1"
+	if muxMode && (network != "tcp" || destination != "") {
+		// streams of a multiplexed session carry their own destinations
+		slog.Debug("bad request", "reason", "invalid multiplexed session", "addr", req.addr)
+		return resp.writeStatus(http.StatusBadRequest)
+	}
+
+	resumeMode := headers.Get("X-Resume")
+	if resumeMode != "" && resumeMode != "new" && resumeMode != "reconnect" {
+		slog.Debug("bad request", "reason", "unknown resume mode", "resume", resumeMode, "addr", req.addr)
+		return resp.writeStatus(http.StatusBadRequest)
+	}
+
+	uploadMode := headers.Get("X-Upload")
+	if uploadMode == "" {
+		uploadMode = "stream"
+	}
+	if uploadMode != "stream" && uploadMode != "packet" {
+		slog.Debug("bad request", "reason", "unknown upload mode", "upload", uploadMode, "addr", req.addr)
+		return resp.writeStatus(http.StatusBadRequest)
+	}
+	packetMode := uploadMode == "packet"
+	if packetMode && (resumeMode != "" || req.websocket != nil) {
+		slog.Debug("bad request", "reason", "packet upload does not support resume or websocket", "addr", req.addr)
+		return resp.writeStatus(http.StatusBadRequest)
+	}
+
+	downloadMode := headers.Get("X-Download")
+	if downloadMode == "" {
+		downloadMode = "stream"
+	}
+	if downloadMode != "stream" && downloadMode != "poll" {
+		slog.Debug("bad request", "reason", "unknown download mode", "download", downloadMode, "addr", req.addr)
+		return resp.writeStatus(http.StatusBadRequest)
+	}
+	pollMode := downloadMode == "poll"
+	if pollMode && (resumeMode != "" || req.websocket != nil) {
+		slog.Debug("bad request", "reason", "poll download does not support resume or websocket", "addr", req.addr)
+		return resp.writeStatus(http.StatusBadRequest)
+	}
+
+	if req.websocket != nil && (method != http.MethodGet || resumeMode != "") {
+		slog.Debug("bad request", "reason", "invalid websocket request", "addr", req.addr)
+		return resp.writeStatus(http.StatusBadRequest)
+	}
+
+	var resumeOffset uint64
+	if resumeMode != "" {
+		var err error
+		resumeOffset, err = strconv.ParseUint(headers.Get("X-Resume-Offset"), 10, 64)
+		if err != nil {
+			slog.Debug("bad request", "reason", "invalid resume offset", "addr", req.addr)
+			return resp.writeStatus(http.StatusBadRequest)
+		}
 	}
 
 	// get session
-	sess := s.findSession(sessionId)
+	var sess *session
+	if resumeMode == "reconnect" {
+		// never create a new session for a reconnecting client, the old
+		// session has ended and its data is lost
+		v, ok := s.sessions.Load(sessionId)
+		if !ok {
+			slog.Debug("not found", "reason", "session to resume not found", "sessionId", sessionId, "addr", req.addr)
+			return resp.writeStatus(http.StatusNotFound)
+		}
+		sess = v.(*session)
+	} else if v, ok := s.sessions.Load(sessionId); ok {
+		sess = v.(*session)
+	} else {
+		if !opensSession(method, headers, packetMode, pollMode) {
+			// a late or retried request of a session which has ended
+			slog.Debug("gone", "reason", "session not found", "sessionId", sessionId, "addr", req.addr)
+			return resp.writeStatus(http.StatusGone)
+		}
+		if s.closing.Load() {
+			slog.Debug("service unavailable", "reason", "shutting down", "addr", req.addr)
+			return resp.writeStatus(http.StatusServiceUnavailable)
+		}
+
+		sess = &session{
+			sessionId:   sessionId,
+			settings:    current,
+			created:     time.Now(),
+			destination: destination,
+			network:     network,
+			mux:         muxMode,
+			ch:          make(chan struct{}),
+		}
+		sess.dial = func(network string, address string) (net.Conn, error) {
+			return s.dialRemote(sess, network, address)
+		}
+		if limited && current.maxSessions > 0 {
+			if !s.limits.acquireSession(addr, current.maxSessions) {
+				slog.Debug("too many requests", "reason", "concurrent sessions", "client", addr, "addr", req.addr)
+				metrics.ServerRateLimited.Inc("sessions")
+				return s.refuse(req, current, http.StatusTooManyRequests)
+			}
+			sess.release = append(sess.release, func() {
+				s.limits.releaseSession(addr)
+			})
+		}
+		if resumeMode != "" {
+			sess.ep = resume.NewEndpoint()
+		}
+		if packetMode {
+			sess.packets = newPacketBuffer()
+		}
+		if pollMode {
+			sess.polls = newPollBuffer()
+		}
+		s.setSessionLimiters(sess, addr, credential)
+
+		stored := s.findSession(sess)
+		if stored != sess {
+			// another request created the session first
+			sess.close()
+		}
+		sess = stored
+	}
+
+	slog.Info("new request", "method", method, "sessionId", sessionId, "addr", req.addr, "destination", destination, "network", network, "mux", muxMode, "resume", resumeMode, "upload", uploadMode, "download", downloadMode)
 
-	slog.Info("new request", "method", method, "sessionId", sessionId, "addr", conn.RemoteAddr())
+	if sess.destination != destination || sess.network != network || sess.mux != muxMode || (sess.ep != nil) != (resumeMode != "") || (sess.packets != nil) != packetMode || (sess.polls != nil) != pollMode {
+		slog.Debug("bad request", "reason", "session mismatch", "addr", req.addr)
+		return resp.writeStatus(http.StatusBadRequest)
+	}
+
+	sess.Lock()
+	if method == http.MethodPost || req.websocket != nil {
+		sess.upAddr = req.addr
+	}
+	if method == http.MethodGet {
+		sess.downAddr = req.addr
+	}
+	sess.Unlock()
+
+	// streams of multiplexed sessions are connected when they are opened
+	if !sess.mux {
+		_, err := sess.connect()
+		if err != nil {
+			sess.close()
+			s.sessions.CompareAndDelete(sessionId, sess)
+		}
+		if errors.Is(err, errNotAllowed) {
+			slog.Debug("forbidden", "reason", "destination not allowed", "destination", destination, "error", err, "addr", req.addr)
+			return resp.writeStatus(http.StatusForbidden)
+		}
+		if err != nil {
+			slog.Error("dial remote", "error", err, "sessionId", sessionId, "destination", destination)
+			return resp.writeStatus(http.StatusBadGateway)
+		}
+	}
+
+	if req.websocket != nil {
+		return s.handleWebSocket(req, sess)
+	}
+
+	if sess.ep != nil {
+		if method == http.MethodGet {
+			return s.handleResumableDownload(resp, sess, resumeOffset)
+		}
+
+		if resumeOffset > sess.ep.RecvOffset() {
+			slog.Debug("conflict", "reason", "resume offset ahead of received data", "sessionId", sessionId, "addr", req.addr)
+			return resp.writeStatus(http.StatusConflict)
+		}
+		return s.handleResumableUpload(req.body, resp, sess)
+	}
 
 	// handle request
+	if method == http.MethodGet && sess.polls != nil {
+		return s.handlePoll(req, sess)
+	}
+
 	if method == http.MethodGet {
 		sess.Lock()
 
 		if sess.down != nil {
 			sess.Unlock()
 			// donwload connection already exists
-			slog.Debug("bad request", "reason", "donwload connection already exists", "addr", conn.RemoteAddr())
-			return s.writeResponse(http.StatusBadRequest, conn)
+			slog.Debug("bad request", "reason", "donwload connection already exists", "addr", req.addr)
+			return resp.writeStatus(http.StatusBadRequest)
 		}
 		sess.Unlock()
 
-		return s.handleDownload(bufReader, conn, sess)
+		return s.handleDownload(resp, sess)
+	}
+
+	if method == http.MethodPost && sess.packets != nil {
+		return s.handlePacketUpload(req, sess)
 	}
 
 	if method == http.MethodPost {
@@ -267,73 +1134,71 @@ func (s *server) handleConnection(conn net.Conn) error {
 		if sess.up != nil {
 			sess.Unlock()
 			// upload connection already exists
-			slog.Debug("bad request", "reason", "upload connection already exists", "addr", conn.RemoteAddr())
-			return s.writeResponse(http.StatusBadRequest, conn)
+			slog.Debug("bad request", "reason", "upload connection already exists", "addr", req.addr)
+			return resp.writeStatus(http.StatusBadRequest)
 		}
 		sess.Unlock()
 
-		return s.handleUpload(bufReader, conn, sess)
+		return s.handleUpload(req.body, resp, sess)
 	}
 
 	panic("impossible to reach here")
 }
 
+// whether a request may create its session when none is found
+//
+// upload packets after the first one, and polls after the first data, belong
+// to a session which has ended if it is not found
+func opensSession(method string, headers textproto.MIMEHeader, packetMode bool, pollMode bool) bool {
+	if method == http.MethodPost && packetMode {
+		seq, err := strconv.ParseUint(headers.Get("X-Seq"), 10, 64)
+		return err == nil && seq == 0
+	}
+	if method == http.MethodGet && pollMode {
+		cursor, err := strconv.ParseUint(headers.Get("X-Cursor"), 10, 64)
+		return err == nil && cursor == 0
+	}
+	return true
+}
+
 // handle upload connection
-func (s *server) handleUpload(reader io.Reader, writer io.Writer, sess *session) error {
+func (s *Server) handleUpload(reader io.Reader, resp responder, sess *session) error {
 	sess.Lock()
 	sess.up = reader
 	sess.timeActive = time.Now().Unix()
-
-	ready := sess.up != nil && sess.down != nil
-
-	if ready {
-		slog.Info("session ready", "sessionId", sess.sessionId)
-		go sess.copy(s.remote)
-	}
-
+	sess.startIfReady()
 	sess.Unlock()
 
 	<-sess.ch // waiting the session to end
 	slog.Debug("upload connection ends", "sessionId", sess.sessionId)
 
-	// remove the session from the map
-	s.sessions.Delete(sess.sessionId)
+	// remove the session from the map, a polled session is removed once the
+	// client has polled all download data
+	if sess.polls == nil {
+		s.sessions.Delete(sess.sessionId)
+	}
 
-	return s.writeResponse(http.StatusOK, writer)
+	return resp.writeStatus(http.StatusOK)
 }
 
 // handle download connection
-func (s *server) handleDownload(_ io.Reader, writer io.Writer, sess *session) error {
-	resp := "HTTP/1.1 200 OK\r\n"
-	resp += "Transfer-Encoding: chunked\r\n"
-	resp += "Content-Type: application/octet-stream\r\n"
-	resp += "Connection: close\r\n"
-	resp += "\r\n"
-	_, err := writer.Write([]byte(resp))
+func (s *Server) handleDownload(resp responder, sess *session) error {
+	down, err := resp.startStream()
 	if err != nil {
 		return err
 	}
 
 	sess.Lock()
-	sess.down = writer
+	sess.down = down
 	sess.timeActive = time.Now().Unix()
-
-	ready := sess.up != nil && sess.down != nil
-
-	if ready {
-		slog.Info("session ready", "sessionId", sess.sessionId)
-		go sess.copy(s.remote)
-	}
-
+	sess.startIfReady()
 	sess.Unlock()
 
 	<-sess.ch // waiting the session to end
 
-	// https://www.rfc-editor.org/rfc/rfc9112#section-7.1
-	// sending an empty chunk to close the stream
-	_, err = writer.Write([]byte("0\r\n\r\n"))
+	err = resp.endStream()
 	if err != nil {
-		slog.Error("download connection write 0 chunk", "err", err)
+		slog.Error("download connection end stream", "err", err)
 	}
 
 	slog.Debug("download connection ends", "sessionId", sess.sessionId)
@@ -344,10 +1209,98 @@ func (s *server) handleDownload(_ io.Reader, writer io.Writer, sess *session) er
 	return nil
 }
 
-func NewServer(listen string, remote string) *server {
-	return &server{
+// check the auth token of a request, and return the name of the credential
+// whose secret verified it, empty for Secret or without authentication
+//
+// a request of a session created before the secrets were changed by Reload
+// is checked against the secrets of the session
+func (s *Server) authenticate(current *settings, sessionId string, token string) (string, error) {
+	if v, ok := s.sessions.Load(sessionId); ok {
+		old := v.(*session).settings
+		if old != current {
+			credential, err := old.verify(sessionId, token)
+			if err == nil {
+				return credential, nil
+			}
+		}
+	}
+
+	return current.verify(sessionId, token)
+}
+
+// check token against the secret and the credentials of c
+func (c *settings) verify(sessionId string, token string) (string, error) {
+	if c.secret == "" && len(c.credentials) == 0 {
+		return "", nil
+	}
+
+	// the first error is returned if no secret verifies the token
+	now := time.Now()
+	var err error
+	if c.secret != "" {
+		err = auth.VerifyToken(c.secret, sessionId, token, now)
+		if err == nil {
+			return "", nil
+		}
+	}
+	for _, credential := range c.credentials {
+		credentialErr := auth.VerifyToken(credential.Secret, sessionId, token, now)
+		if credentialErr == nil {
+			return credential.Name, nil
+		}
+		if err == nil {
+			err = credentialErr
+		}
+	}
+	return "", err
+}
+
+// Reload applies the remote, secrets, allowlist, resume grace period, decoy
+// and limits of opts to sessions created from now on. Existing sessions keep
+// the settings they were created with, except for the bandwidth limits which
+// apply to them at once.
+//
+// the listen addresses, the certificate and the acme options can not be
+// changed
+func (s *Server) Reload(opts Options) error {
+	if opts.Listen != s.listen || opts.H3Listen != s.h3Listen || opts.CertFile != s.certFile || opts.KeyFile != s.keyFile || opts.TLS != s.tls {
+		return fmt.Errorf("listen addresses, tls and certificate can not be reloaded")
+	}
+	if !slices.Equal(opts.ACMEDomains, s.acmeOpts.ACMEDomains) || opts.ACMECacheDir != s.acmeOpts.ACMECacheDir || opts.ACMEEmail != s.acmeOpts.ACMEEmail || opts.ACMEDirectory != s.acmeOpts.ACMEDirectory || opts.ACMECAFile != s.acmeOpts.ACMECAFile {
+		return fmt.Errorf("acme options can not be reloaded")
+	}
+
+	current := newSettings(opts)
+	s.settings.Store(current)
+	s.setBandwidth(current)
+	return nil
+}
+
+func NewServer(opts Options) *Server {
+	s := &Server{
 		sessions: sync.Map{},
-		listen:   listen,
-		remote:   remote,
+		listen:   opts.Listen,
+		h3Listen: opts.H3Listen,
+		certFile: opts.CertFile,
+		keyFile:  opts.KeyFile,
+		tls:      opts.TLS,
+		acmeOpts: Options{
+			ACMEDomains:   opts.ACMEDomains,
+			ACMECacheDir:  opts.ACMECacheDir,
+			ACMEEmail:     opts.ACMEEmail,
+			ACMEDirectory: opts.ACMEDirectory,
+			ACMECAFile:    opts.ACMECAFile,
+		},
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+		accepted: make(chan net.Conn, ACCEPT_BACKLOG),
+		limits:   newRateLimiter(),
+
+		bandwidth:   newLimiterPair(opts.Bandwidth),
+		clients:     make(map[netip.Addr]*sharedLimiters),
+		credentials: make(map[string]*sharedLimiters),
 	}
+	s.settings.Store(newSettings(opts))
+
+	return s
 }
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"commonweb2/metrics"
+	"net"
+	"sort"
+	"time"
+)
+
+// SessionInfo describes a session of a server
+type SessionInfo struct {
+	Id       string
+	UpAddr   string // address of the last upload request, empty if none yet
+	DownAddr string // address of the last download request, empty if none yet
+	Created  time.Time
+
+	// unpaired: waiting for the upload or download request
+	// active: copying data
+	// detached: a resumable session which lost a request
+	// closed: ended, but not yet removed
+	State  string
+	Paired bool // both requests have arrived and copying has started
+
+	BytesUp   uint64 // bytes sent to remote
+	BytesDown uint64 // bytes received from remote
+
+	Destination string // destination requested by the client, empty for remote
+	Remote      string // remote of the server when the session was created
+	Network     string // tcp / udp
+	Mux         bool
+	Resume      bool
+	Upload      string // stream / packet
+	Download    string // stream / poll
+}
+
+// describe the session
+func (s *session) info() SessionInfo {
+	s.Lock()
+	defer s.Unlock()
+
+	info := SessionInfo{
+		Id:          s.sessionId,
+		UpAddr:      s.upAddr,
+		DownAddr:    s.downAddr,
+		Created:     s.created,
+		Paired:      s.started,
+		BytesUp:     s.bytesUp.Load(),
+		BytesDown:   s.bytesDown.Load(),
+		Destination: s.destination,
+		Remote:      s.settings.remote,
+		Network:     s.network,
+		Mux:         s.mux,
+		Resume:      s.ep != nil,
+		Upload:      "stream",
+		Download:    "stream",
+	}
+
+	if s.packets != nil {
+		info.Upload = "packet"
+	}
+	if s.polls != nil {
+		info.Download = "poll"
+	}
+
+	switch {
+	case s.isClosed():
+		info.State = "closed"
+	case !s.started:
+		info.State = "unpaired"
+	case s.up == nil || s.down == nil:
+		info.State = "detached"
+	default:
+		info.State = "active"
+	}
+
+	return info
+}
+
+// Sessions describes the sessions of the server, oldest first
+func (s *Server) Sessions() []SessionInfo {
+	var list []SessionInfo
+
+	s.sessions.Range(func(key, value any) bool {
+		list = append(list, value.(*session).info())
+		return true
+	})
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// Session describes the session with the id, false if there is none
+func (s *Server) Session(id string) (SessionInfo, bool) {
+	v, ok := s.sessions.Load(id)
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return v.(*session).info(), true
+}
+
+// CloseSession closes the session with the id and its connections, false
+// if there is none
+func (s *Server) CloseSession(id string) bool {
+	v, ok := s.sessions.Load(id)
+	if !ok {
+		return false
+	}
+
+	sess := v.(*session)
+	sess.close()
+	s.sessions.CompareAndDelete(id, sess)
+
+	return true
+}
+
+// a connection to remote, counting the bytes of the session
+type countedConn struct {
+	net.Conn
+	sess *session
+}
+
+// count the bytes sent to and received from remote over conn, in the
+// session and the metrics
+func (s *session) countConn(conn net.Conn) net.Conn {
+	return &countedConn{
+		Conn: metrics.CountConn(conn, metrics.ServerBytes, "up", "down"),
+		sess: s,
+	}
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.sess.bytesDown.Add(uint64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sess.bytesUp.Add(uint64(n))
+	return n, err
+}
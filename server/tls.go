@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// timeout of the tls handshake of a connection
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// how often the certificate files are checked for changes
+const CERT_CHECK_INTERVAL = time.Second
+
+// the certificate of the server, loaded again when its files change
+type certificate struct {
+	certFile string
+	keyFile  string
+
+	cert    atomic.Pointer[tls.Certificate]
+	checked atomic.Int64 // unix nanoseconds of the last check of the files
+
+	mu       sync.Mutex   // held while checking the files
+	modified [2]time.Time // of the certificate and key files when they were loaded
+}
+
+func loadCertificate(certFile string, keyFile string) (*certificate, error) {
+	c := &certificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	modified, err := c.modTimes()
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+
+	c.cert.Store(&cert)
+	c.checked.Store(time.Now().UnixNano())
+	c.modified = modified
+	return c, nil
+}
+
+// the modification times of the certificate and key files
+func (c *certificate) modTimes() ([2]time.Time, error) {
+	var modified [2]time.Time
+
+	for i, file := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return modified, err
+		}
+		modified[i] = fi.ModTime()
+	}
+
+	return modified, nil
+}
+
+// get returns the certificate, the files are checked at most once per
+// CERT_CHECK_INTERVAL and loaded again if they have changed since they were
+// loaded. Handshakes during a check get the current certificate.
+//
+// the previous certificate is kept if the files can not be loaded, for
+// example while only one of them has been replaced
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	now := time.Now()
+	if now.UnixNano()-c.checked.Load() < int64(CERT_CHECK_INTERVAL) || !c.mu.TryLock() {
+		return c.cert.Load(), nil
+	}
+	defer c.mu.Unlock()
+
+	if now.UnixNano()-c.checked.Load() < int64(CERT_CHECK_INTERVAL) {
+		// checked by another handshake
+		return c.cert.Load(), nil
+	}
+	c.checked.Store(now.UnixNano())
+
+	modified, err := c.modTimes()
+	if err != nil || modified == c.modified {
+		return c.cert.Load(), nil
+	}
+	c.modified = modified
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		slog.Warn("reload certificate", "error", err, "cert", c.certFile, "key", c.keyFile)
+		return c.cert.Load(), nil
+	}
+
+	slog.Info("certificate reloaded", "cert", c.certFile, "key", c.keyFile)
+	c.cert.Store(&cert)
+	return &cert, nil
+}
+
+// the tls config of the tcp listener
+//
+// h2 is offered before http/1.1, both are served. acme-tls/1 is only
+// negotiated by tls-alpn-01 challenges.
+func (s *Server) tlsConfig() *tls.Config {
+	if s.acme != nil {
+		return &tls.Config{
+			GetCertificate: s.acme.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+		}
+	}
+
+	return &tls.Config{
+		GetCertificate: s.cert.get,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"commonweb2/websocket"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// handle a websocket connection, which carries both directions of the session
+func (s *Server) handleWebSocket(req *request, sess *session) error {
+	ws, err := req.websocket()
+	if errors.Is(err, websocket.ErrProtocol) {
+		slog.Debug("bad request", "reason", "invalid websocket handshake", "error", err, "addr", req.addr)
+		return req.resp.writeStatus(http.StatusBadRequest)
+	}
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	sess.Lock()
+	if sess.up != nil || sess.down != nil {
+		sess.Unlock()
+		// the session is carried by other connections
+		slog.Debug("bad request", "reason", "session connections already exist", "addr", req.addr)
+		return nil
+	}
+	sess.up = ws
+	sess.down = ws
+	sess.timeActive = time.Now().Unix()
+	sess.startIfReady()
+	sess.Unlock()
+
+	<-sess.ch // waiting the session to end
+	slog.Debug("websocket connection ends", "sessionId", sess.sessionId)
+
+	// remove the session from the map
+	s.sessions.Delete(sess.sessionId)
+
+	return nil
+}
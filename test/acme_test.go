@@ -0,0 +1,492 @@
+package test
+
+import (
+	"bytes"
+	"commonweb2/client"
+	"commonweb2/server"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the certificate extension holding the key authorization of a tls-alpn-01
+// challenge
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// a minimal acme certificate authority, offering one challenge type and
+// validating it against the server at target
+//
+// the signatures of requests are not checked
+type fakeACME struct {
+	t         *testing.T
+	url       string // base url of the endpoints
+	challenge string // http-01 / tls-alpn-01
+	target    string
+	root      *x509.Certificate
+	rootKey   *ecdsa.PrivateKey
+
+	mu         sync.Mutex
+	thumbprint string // of the account key
+	orders     []*fakeOrder
+}
+
+type fakeOrder struct {
+	domain string
+	token  string
+	status string // pending / ready / valid / invalid
+	chain  []byte // pem encoded, once finalized
+}
+
+// start the authority on listen over https, with the certificate of
+// certFile and keyFile
+func startFakeACME(t *testing.T, listen string, certFile string, keyFile string, challenge string, target string) *http.Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generate key", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake acme root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("create certificate", err)
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("parse certificate", err)
+	}
+
+	ca := &fakeACME{
+		t:         t,
+		url:       "https://" + listen,
+		challenge: challenge,
+		target:    target,
+		root:      root,
+		rootKey:   key,
+	}
+
+	srv := &http.Server{Addr: listen, Handler: ca}
+	go srv.ListenAndServeTLS(certFile, keyFile)
+
+	return srv
+}
+
+func (ca *fakeACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+
+	if r.URL.Path == "/dir" {
+		ca.reply(w, http.StatusOK, "", map[string]string{
+			"newNonce":   ca.url + "/nonce",
+			"newAccount": ca.url + "/account",
+			"newOrder":   ca.url + "/order",
+			"revokeCert": ca.url + "/revoke",
+			"keyChange":  ca.url + "/key",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var body struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		ca.fail(w, "decode jws: %v", err)
+		return
+	}
+	protected, _ := base64.RawURLEncoding.DecodeString(body.Protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(body.Payload)
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	// /account, /order, or /<endpoint>/<order index>
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] == "account" {
+		ca.newAccount(w, protected)
+		return
+	}
+	if len(parts) == 1 && parts[0] == "order" {
+		ca.newOrder(w, payload)
+		return
+	}
+
+	if len(parts) != 2 {
+		ca.fail(w, "unknown endpoint %s", r.URL.Path)
+		return
+	}
+	i, err := strconv.Atoi(parts[1])
+	if err != nil || i >= len(ca.orders) {
+		ca.fail(w, "unknown order %s", r.URL.Path)
+		return
+	}
+	o := ca.orders[i]
+
+	switch parts[0] {
+	case "order":
+		ca.reply(w, http.StatusOK, "", ca.orderObject(i))
+	case "authz":
+		ca.reply(w, http.StatusOK, "", ca.authzObject(i))
+	case "chal":
+		ca.validate(o)
+		ca.reply(w, http.StatusOK, "", ca.challengeObject(i))
+	case "finalize":
+		ca.finalize(w, i, payload)
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(o.chain)
+	default:
+		ca.fail(w, "unknown endpoint %s", r.URL.Path)
+	}
+}
+
+// write v as json, with a Location header if location is not empty
+func (ca *fakeACME) reply(w http.ResponseWriter, code int, location string, v any) {
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ca *fakeACME) fail(w http.ResponseWriter, format string, a ...any) {
+	detail := fmt.Sprintf(format, a...)
+	ca.t.Error("fake acme:", detail)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:malformed",
+		"detail": detail,
+	})
+}
+
+// register the account, remembering the thumbprint of its key
+func (ca *fakeACME) newAccount(w http.ResponseWriter, protected []byte) {
+	var header struct {
+		JWK struct {
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"jwk"`
+	}
+	json.Unmarshal(protected, &header)
+
+	if header.JWK.Crv != "" {
+		// the members of an ec key in lexicographic order, RFC 7638
+		canonical := fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, header.JWK.Crv, header.JWK.X, header.JWK.Y)
+		sum := sha256.Sum256([]byte(canonical))
+		ca.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	ca.reply(w, http.StatusCreated, ca.url+"/account/0", map[string]string{"status": "valid"})
+}
+
+func (ca *fakeACME) newOrder(w http.ResponseWriter, payload []byte) {
+	var req struct {
+		Identifiers []struct {
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	json.Unmarshal(payload, &req)
+	if len(req.Identifiers) != 1 {
+		ca.fail(w, "orders must have one identifier, got %d", len(req.Identifiers))
+		return
+	}
+
+	ca.orders = append(ca.orders, &fakeOrder{
+		domain: req.Identifiers[0].Value,
+		token:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		status: "pending",
+	})
+	i := len(ca.orders) - 1
+
+	ca.reply(w, http.StatusCreated, fmt.Sprintf("%s/order/%d", ca.url, i), ca.orderObject(i))
+}
+
+func (ca *fakeACME) orderObject(i int) map[string]any {
+	o := ca.orders[i]
+	obj := map[string]any{
+		"status":         o.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": o.domain}},
+		"authorizations": []string{fmt.Sprintf("%s/authz/%d", ca.url, i)},
+		"finalize":       fmt.Sprintf("%s/finalize/%d", ca.url, i),
+	}
+	if o.status == "valid" {
+		obj["certificate"] = fmt.Sprintf("%s/cert/%d", ca.url, i)
+	}
+	return obj
+}
+
+func (ca *fakeACME) authzStatus(o *fakeOrder) string {
+	switch o.status {
+	case "ready", "valid":
+		return "valid"
+	}
+	return o.status
+}
+
+func (ca *fakeACME) challengeObject(i int) map[string]any {
+	return map[string]any{
+		"type":   ca.challenge,
+		"url":    fmt.Sprintf("%s/chal/%d", ca.url, i),
+		"token":  ca.orders[i].token,
+		"status": ca.authzStatus(ca.orders[i]),
+	}
+}
+
+func (ca *fakeACME) authzObject(i int) map[string]any {
+	return map[string]any{
+		"identifier": map[string]string{"type": "dns", "value": ca.orders[i].domain},
+		"status":     ca.authzStatus(ca.orders[i]),
+		"challenges": []map[string]any{ca.challengeObject(i)},
+	}
+}
+
+// validate the challenge of o against the target, like a real authority
+// would against the address of the domain
+func (ca *fakeACME) validate(o *fakeOrder) {
+	keyAuth := o.token + "." + ca.thumbprint
+
+	var err error
+	if ca.challenge == "http-01" {
+		err = validateHTTP01(ca.target, o.domain, o.token, keyAuth)
+	} else {
+		err = validateTLSALPN01(ca.target, o.domain, keyAuth)
+	}
+
+	if err != nil {
+		ca.t.Error("fake acme: validate", ca.challenge, err)
+		o.status = "invalid"
+		return
+	}
+	o.status = "ready"
+}
+
+func validateHTTP01(target string, domain string, token string, keyAuth string) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+target+"/.well-known/acme-challenge/"+token, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = domain
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != keyAuth {
+		return fmt.Errorf("wrong response %d %q", resp.StatusCode, body)
+	}
+	return nil
+}
+
+func validateTLSALPN01(target string, domain string, keyAuth string) error {
+	conn, err := tls.Dial("tcp", target, &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" {
+		return fmt.Errorf("acme-tls/1 not negotiated: %q", state.NegotiatedProtocol)
+	}
+
+	sum := sha256.Sum256([]byte(keyAuth))
+	want, _ := asn1.Marshal(sum[:])
+
+	for _, ext := range state.PeerCertificates[0].Extensions {
+		if ext.Id.Equal(idPeAcmeIdentifier) && bytes.Equal(ext.Value, want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no matching acmeIdentifier extension")
+}
+
+// sign the csr of order i with the root
+func (ca *fakeACME) finalize(w http.ResponseWriter, i int, payload []byte) {
+	o := ca.orders[i]
+	if o.status != "ready" {
+		ca.fail(w, "order %d is %s, not ready", i, o.status)
+		return
+	}
+
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	json.Unmarshal(payload, &req)
+	der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		ca.fail(w, "parse csr: %v", err)
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(i) + 2),
+		Subject:      pkix.Name{CommonName: o.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, ca.root, csr.PublicKey, ca.rootKey)
+	if err != nil {
+		ca.fail(w, "create certificate: %v", err)
+		return
+	}
+
+	o.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})...)
+	o.status = "valid"
+
+	ca.reply(w, http.StatusOK, fmt.Sprintf("%s/order/%d", ca.url, i), ca.orderObject(i))
+}
+
+// the certificate served on addr for domain, verified against root
+func dialACME(t *testing.T, addr string, domain string, root *x509.Certificate) []byte {
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName: domain,
+		RootCAs:    roots,
+		NextProtos: []string{"http/1.1"},
+	})
+	if err != nil {
+		t.Fatal("dial tls", err)
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].Raw
+}
+
+// testing certificates obtained with each challenge type, and loaded from
+// the cache once the authority is gone
+func TestACME(t *testing.T) {
+	const domain = "tunnel.example"
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30078", &accepted)
+	defer l.Close()
+
+	for i, challenge := range []string{"http-01", "tls-alpn-01"} {
+		listen := fmt.Sprintf("127.0.0.1:%d", 20060+2*i)
+		caListen := fmt.Sprintf("127.0.0.1:%d", 20061+2*i)
+
+		// the authority is served over https with a certificate trusted
+		// through ACMECAFile
+		caCertFile, caKeyFile := writeCertFiles(t)
+		caServer := startFakeACME(t, caListen, caCertFile, caKeyFile, challenge, listen)
+		ca := caServer.Handler.(*fakeACME)
+
+		opts := server.Options{
+			Listen:        listen,
+			Remote:        "127.0.0.1:30078",
+			ACMEDomains:   []string{domain},
+			ACMECacheDir:  t.TempDir(),
+			ACMEDirectory: "https://" + caListen + "/dir",
+			ACMECAFile:    caCertFile,
+		}
+		s := server.NewServer(opts)
+		go s.Start()
+
+		time.Sleep(time.Second) // wait for the servers to start
+
+		first := dialACME(t, listen, domain, ca.root)
+
+		// plain http requests other than challenges are not redirected,
+		// they are served like on a listener without tls
+		httpClient := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := httpClient.Get("http://" + listen + "/")
+		if err != nil {
+			t.Fatal("get", challenge, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Location") != "" {
+			t.Fatal("plain http redirected", challenge, resp.StatusCode)
+		}
+
+		c := client.NewClient(client.Options{
+			Up:   "http://" + listen + "/",
+			Down: "http://" + listen + "/",
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		conn, err := c.DialContext(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal("dial plain http", challenge, err)
+		}
+		echoOnce(t, conn, 64*1024)
+		conn.Close()
+		c.Close()
+
+		s.Close()
+		caServer.Close()
+
+		files, err := os.ReadDir(opts.ACMECacheDir)
+		if err != nil || len(files) == 0 {
+			t.Fatal("nothing cached", challenge, err)
+		}
+
+		// the certificate is read from the cache
+		s = server.NewServer(opts)
+		go s.Start()
+		defer s.Close()
+
+		time.Sleep(time.Second) // wait for the server to start
+
+		second := dialACME(t, listen, domain, ca.root)
+		if !bytes.Equal(first, second) {
+			t.Fatal("certificate not loaded from the cache", challenge)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"commonweb2/admin"
+	"commonweb2/client"
+	"commonweb2/server"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// send a request to the admin api, the response body is decoded into v
+func adminRequest(t *testing.T, method string, url string, token string, v any) int {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal("new request", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("admin request", err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err != nil {
+			t.Fatal("decode response", err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+// testing listing, showing and closing a session with the admin api
+func TestAdmin(t *testing.T) {
+	c := client.NewClient(client.Options{
+		Up:     "http://127.0.0.1:20051",
+		Down:   "http://127.0.0.1:20051",
+		Listen: "127.0.0.1:30058",
+	})
+	go c.Start()
+	defer c.Close()
+
+	s := server.NewServer(server.Options{
+		Listen: "127.0.0.1:20051",
+		Remote: "127.0.0.1:30059",
+	})
+	go s.Start()
+	defer s.Close()
+
+	_, err := admin.Listen("0.0.0.0:20052")
+	if err == nil {
+		t.Fatal("admin api listening on a public address")
+	}
+
+	l, err := admin.Listen("127.0.0.1:20052")
+	if err != nil {
+		t.Fatal("admin listen", err)
+	}
+	defer l.Close()
+
+	go http.Serve(l, admin.Handler("admin token", func() map[string]admin.Source {
+		return map[string]admin.Source{"test": s}
+	}))
+
+	var accepted atomic.Int32
+	echo := startEchoServer(t, "127.0.0.1:30059", &accepted)
+	defer echo.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	conn, err := net.Dial("tcp", "127.0.0.1:30058")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	echoOnce(t, conn, 64*1024)
+
+	if adminRequest(t, http.MethodGet, "http://127.0.0.1:20052/sessions", "wrong token", nil) != http.StatusUnauthorized {
+		t.Fatal("wrong token accepted")
+	}
+
+	var list []struct {
+		Tunnel    string `json:"tunnel"`
+		Id        string `json:"id"`
+		State     string `json:"state"`
+		Paired    bool   `json:"paired"`
+		UpAddr    string `json:"up_addr"`
+		BytesUp   uint64 `json:"bytes_up"`
+		BytesDown uint64 `json:"bytes_down"`
+	}
+	code := adminRequest(t, http.MethodGet, "http://127.0.0.1:20052/sessions", "admin token", &list)
+	if code != http.StatusOK || len(list) != 1 {
+		t.Fatal("wrong session list", code, list)
+	}
+
+	sess := list[0]
+	if sess.Tunnel != "test" || sess.State != "active" || !sess.Paired || sess.UpAddr == "" || sess.BytesUp != 64*1024 || sess.BytesDown != 64*1024 {
+		t.Fatal("wrong session", sess)
+	}
+
+	var detail struct {
+		Id     string `json:"id"`
+		Remote string `json:"remote"`
+		Upload string `json:"upload"`
+	}
+	code = adminRequest(t, http.MethodGet, "http://127.0.0.1:20052/sessions/"+sess.Id, "admin token", &detail)
+	if code != http.StatusOK || detail.Id != sess.Id || detail.Remote != "127.0.0.1:30059" || detail.Upload != "stream" {
+		t.Fatal("wrong session detail", code, detail)
+	}
+
+	code = adminRequest(t, http.MethodDelete, "http://127.0.0.1:20052/sessions/"+sess.Id, "admin token", nil)
+	if code != http.StatusNoContent {
+		t.Fatal("close session", code)
+	}
+
+	// the local connection ends with the session
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatal("connection not closed", err)
+	}
+
+	if adminRequest(t, http.MethodGet, "http://127.0.0.1:20052/sessions/"+sess.Id, "admin token", nil) != http.StatusNotFound {
+		t.Fatal("closed session still listed")
+	}
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"commonweb2/client"
+	"commonweb2/server"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testing sessions authenticated with a shared secret
+func TestAuth(t *testing.T) {
+	testDate := randomBytes(4096)
+
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:     "http://127.0.0.1:20011",
+		Down:   "http://127.0.0.1:20011",
+		Listen: "127.0.0.1:30011",
+		Secret: "secret",
+	}, server.Options{
+		Listen: "127.0.0.1:20011",
+		Remote: "127.0.0.1:30021",
+		Secret: "secret",
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:30021")
+	if err != nil {
+		t.Fatal("remote listen", err)
+	}
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	conn, err := net.Dial("tcp", "127.0.0.1:30011")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(testDate)
+	if err != nil {
+		t.Fatal("write", err)
+	}
+
+	remote, err := l.Accept()
+	if err != nil {
+		t.Fatal("remote accept", err)
+	}
+	defer remote.Close()
+
+	received := make([]byte, 4096)
+	_, err = io.ReadFull(remote, received)
+	if err != nil {
+		t.Fatal("remote readfull", err)
+	}
+
+	if !bytes.Equal(received, testDate) {
+		t.Fatal("received wrong data")
+	}
+}
+
+// testing requests without a valid token are rejected
+func TestAuthRejected(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:     "http://127.0.0.1:20012",
+		Down:   "http://127.0.0.1:20012",
+		Listen: "127.0.0.1:30012",
+		Secret: "wrong secret",
+	}, server.Options{
+		Listen: "127.0.0.1:20012",
+		Remote: "127.0.0.1:30022",
+		Secret: "secret",
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:30022")
+	if err != nil {
+		t.Fatal("remote listen", err)
+	}
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	for _, token := range []string{"", "1.00", "garbage"} {
+		conn, err := net.Dial("tcp", "127.0.0.1:20012")
+		if err != nil {
+			t.Fatal("dial", err)
+		}
+
+		request := "GET / HTTP/1.1\r\nHost: 127.0.0.1\r\nX-Session-Id: 0123456789abcdef\r\n"
+		if token != "" {
+			request += "X-Auth-Token: " + token + "\r\n"
+		}
+		request += "\r\n"
+
+		_, err = conn.Write([]byte(request))
+		if err != nil {
+			t.Fatal("write", err)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal("read response", err)
+		}
+		conn.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("token %q: expected status 400, got %s", token, resp.Status)
+		}
+	}
+
+	// client with a wrong secret must not reach the remote
+	conn, err := net.Dial("tcp", "127.0.0.1:30012")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("hello"))
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second * 2))
+	remote, err := l.Accept()
+	if err == nil {
+		remote.Close()
+		t.Fatal("remote accepted a connection from an unauthenticated client")
+	}
+}
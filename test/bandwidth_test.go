@@ -0,0 +1,221 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// how long it takes to echo size bytes over each of conns at the same time
+func timeEcho(t *testing.T, size int, conns ...net.Conn) time.Duration {
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			echoOnce(t, conn, size)
+		}(conn)
+	}
+	wg.Wait()
+
+	return time.Since(start)
+}
+
+// testing the bandwidth limits of a session and of a client address, changed
+// by reloading the server
+func TestBandwidth(t *testing.T) {
+	opts := server.Options{
+		Listen:           "127.0.0.1:20066",
+		Remote:           "127.0.0.1:30071",
+		Secret:           "bandwidth secret",
+		SessionBandwidth: server.Bandwidth{Up: 128 * 1024, Down: 128 * 1024},
+	}
+	s := server.NewServer(opts)
+	go s.Start()
+	defer s.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30071", &accepted)
+	defer l.Close()
+
+	c := client.NewClient(client.Options{
+		Up:     "http://127.0.0.1:20066/",
+		Down:   "http://127.0.0.1:20066/",
+		Secret: "bandwidth secret",
+	})
+	defer c.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	dial := func() net.Conn {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		conn, err := c.DialContext(ctx)
+		if err != nil {
+			t.Fatal("dial", err)
+		}
+		return conn
+	}
+
+	// a burst of 128K, then 256K at 128K/s
+	conn := dial()
+	defer conn.Close()
+
+	elapsed := timeEcho(t, 384*1024, conn)
+	if elapsed < 1500*time.Millisecond || elapsed > 10*time.Second {
+		t.Fatal("session limit not applied", elapsed)
+	}
+
+	// the running session is no longer limited, the sessions of the client
+	// address share 128K/s
+	opts.SessionBandwidth = server.Bandwidth{}
+	opts.ClientBandwidth = server.Bandwidth{Down: 128 * 1024}
+	err := s.Reload(opts)
+	if err != nil {
+		t.Fatal("reload", err)
+	}
+
+	elapsed = timeEcho(t, 64*1024, conn)
+	if elapsed > time.Second {
+		t.Fatal("session limit not removed", elapsed)
+	}
+
+	first, second := dial(), dial()
+	defer first.Close()
+	defer second.Close()
+
+	// a burst of 128K, then 256K at 128K/s
+	elapsed = timeEcho(t, 192*1024, first, second)
+	if elapsed < 1500*time.Millisecond || elapsed > 10*time.Second {
+		t.Fatal("client address limit not applied", elapsed)
+	}
+}
+
+// testing the bandwidth limits of the sessions authenticated by a
+// credential
+func TestCredentialBandwidth(t *testing.T) {
+	s := server.NewServer(server.Options{
+		Listen: "127.0.0.1:20074",
+		Remote: "127.0.0.1:30085",
+		Secret: "shared secret",
+		Credentials: []server.Credential{
+			{Name: "limited", Secret: "limited secret", Bandwidth: server.Bandwidth{Down: 128 * 1024}},
+			{Name: "unlimited", Secret: "unlimited secret"},
+		},
+	})
+	go s.Start()
+	defer s.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30085", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	dial := func(secret string) (net.Conn, error) {
+		c := client.NewClient(client.Options{
+			Up:     "http://127.0.0.1:20074/",
+			Down:   "http://127.0.0.1:20074/",
+			Secret: secret,
+		})
+		t.Cleanup(func() { c.Close() })
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		return c.DialContext(ctx)
+	}
+
+	conns := make(map[string]net.Conn)
+	for _, secret := range []string{"limited secret", "limited secret", "unlimited secret", "shared secret"} {
+		conn, err := dial(secret)
+		if err != nil {
+			t.Fatal("dial", secret, err)
+		}
+		defer conn.Close()
+		if _, ok := conns[secret]; ok {
+			secret += " again"
+		}
+		conns[secret] = conn
+	}
+
+	_, err := dial("wrong secret")
+	if err == nil {
+		t.Fatal("session with a wrong secret accepted")
+	}
+
+	// the sessions of other secrets are not limited
+	elapsed := timeEcho(t, 384*1024, conns["unlimited secret"], conns["shared secret"])
+	if elapsed > time.Second {
+		t.Fatal("sessions of other secrets limited", elapsed)
+	}
+
+	// the sessions of the credential share 128K/s, a burst of 128K, then 256K
+	elapsed = timeEcho(t, 192*1024, conns["limited secret"], conns["limited secret again"])
+	if elapsed < 1500*time.Millisecond || elapsed > 10*time.Second {
+		t.Fatal("credential limit not applied", elapsed)
+	}
+}
+
+// testing the bandwidth limit of the connections of a client, changed by
+// reloading the client
+func TestClientBandwidth(t *testing.T) {
+	s := server.NewServer(server.Options{
+		Listen: "127.0.0.1:20069",
+		Remote: "127.0.0.1:30075",
+	})
+	go s.Start()
+	defer s.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30075", &accepted)
+	defer l.Close()
+
+	opts := client.Options{
+		Up:          "http://127.0.0.1:20069/",
+		Down:        "http://127.0.0.1:20069/",
+		BandwidthUp: 128 * 1024,
+	}
+	c := client.NewClient(opts)
+	defer c.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	first, err := c.DialContext(ctx)
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer first.Close()
+	second, err := c.DialContext(ctx)
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer second.Close()
+
+	// a burst of 128K, then 256K at 128K/s
+	elapsed := timeEcho(t, 192*1024, first, second)
+	if elapsed < 1500*time.Millisecond || elapsed > 10*time.Second {
+		t.Fatal("client limit not applied", elapsed)
+	}
+
+	opts.BandwidthUp = 0
+	err = c.Reload(opts)
+	if err != nil {
+		t.Fatal("reload", err)
+	}
+
+	elapsed = timeEcho(t, 256*1024, first, second)
+	if elapsed > time.Second {
+		t.Fatal("client limit not removed", elapsed)
+	}
+}
@@ -0,0 +1,176 @@
+package test
+
+import (
+	"commonweb2/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// write content to a file named name in a temporary directory
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal("write config", err)
+	}
+	return path
+}
+
+// load and validate the configuration file
+func loadConfig(t *testing.T, path string) (config.Config, error) {
+	var c config.Config
+	c.Inbound = "tcp"
+	c.Network = "tcp"
+	c.UploadMode = "stream"
+	c.DownloadMode = "stream"
+
+	err := config.Load(path, &c)
+	if err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+// testing a client configured with yaml and a server configured with json
+func TestConfig(t *testing.T) {
+	clientConfig, err := loadConfig(t, writeConfig(t, "client.yaml", `
+mode: client
+listen: 127.0.0.1:30046
+up: http://127.0.0.1:20044
+down: http://127.0.0.1:20044
+secret: config secret
+mux: 2
+udp_timeout: 30s
+`))
+	if err != nil {
+		t.Fatal("load client config", err)
+	}
+	if clientConfig.Mux != 2 || time.Duration(clientConfig.UDPTimeout) != 30*time.Second || clientConfig.Inbound != "tcp" {
+		t.Fatal("wrong client config", clientConfig)
+	}
+
+	serverConfig, err := loadConfig(t, writeConfig(t, "server.json", `{
+	"mode": "server",
+	"listen": "127.0.0.1:20044",
+	"remote": "127.0.0.1:30047",
+	"secret": "config secret",
+	"resume_grace": "1m",
+	"bandwidth_down": "64M",
+	"session_bandwidth_up": 1048576,
+	"credentials": [{"name": "config user", "secret": "config user secret", "bandwidth_up": "1M"}]
+}`))
+	if err != nil {
+		t.Fatal("load server config", err)
+	}
+
+	serverOpts, err := serverConfig.ServerOptions()
+	if err != nil {
+		t.Fatal("server options", err)
+	}
+	if serverOpts.Bandwidth.Down != 64<<20 || serverOpts.SessionBandwidth.Up != 1<<20 {
+		t.Fatal("wrong bandwidth", serverOpts.Bandwidth, serverOpts.SessionBandwidth)
+	}
+	if len(serverOpts.Credentials) != 1 || serverOpts.Credentials[0].Name != "config user" || serverOpts.Credentials[0].Bandwidth.Up != 1<<20 {
+		t.Fatal("wrong credentials", serverOpts.Credentials)
+	}
+
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, clientConfig.ClientOptions(), serverOpts)
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30047", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testEcho(t, "127.0.0.1:30046", 64*1024)
+}
+
+// testing a client and a server declared as tunnels of one file
+func TestConfigTunnels(t *testing.T) {
+	c, err := loadConfig(t, writeConfig(t, "tunnels.yaml", `
+secret: shared secret
+tunnels:
+  - name: server
+    mode: server
+    listen: 127.0.0.1:20045
+    remote: 127.0.0.1:30049
+  - name: client
+    mode: client
+    listen: 127.0.0.1:30048
+    up: http://127.0.0.1:20045
+    down: http://127.0.0.1:20045
+`))
+	if err != nil {
+		t.Fatal("load config", err)
+	}
+
+	tunnels := c.TunnelList()
+	if len(tunnels) != 2 || tunnels[0].Secret != "shared secret" || tunnels[1].Secret != "shared secret" || tunnels[1].Inbound != "tcp" {
+		t.Fatal("wrong tunnels", tunnels)
+	}
+
+	serverOpts, err := tunnels[0].ServerOptions()
+	if err != nil {
+		t.Fatal("server options", err)
+	}
+
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, tunnels[1].ClientOptions(), serverOpts)
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30049", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testEcho(t, "127.0.0.1:30048", 64*1024)
+}
+
+// testing that invalid configuration files are rejected, naming the field
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"unknown.yaml", "mode: client\nupload_mod: packet\n", "line 2: upload_mod: unknown field"},
+		{"type.yaml", "mode: client\nmux: many\n", "line 2: mux: cannot unmarshal"},
+		{"duration.json", `{"mode": "client", "udp_timeout": 30}`, "line 1: udp_timeout: must be a duration"},
+		{"mode.yaml", "mode: relay\nlisten: 127.0.0.1:1\n", `mode: invalid value "relay"`},
+		{"upload.yaml", "mode: client\nlisten: 127.0.0.1:1\nup: http://a/\ndown: http://a/\nupload_mode: chunks\n", `upload_mode: invalid value "chunks"`},
+		{"remote.json", `{"mode": "server", "listen": "127.0.0.1:1"}`, "remote: must not be empty"},
+		{"allow.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\nallow_ports: [80, 70000]\n", "allow_ports[1]: "},
+		{"tunnels.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\ntunnels:\n- name: a\n- mode: client\n  up: http://a/\n", "tunnels[1].down: must not be empty"},
+		{"h3.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\nh3_listen: 127.0.0.1:3\n", "h3_listen: requires cert and key"},
+		{"tls.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\ntls: true\n", "tls: requires cert and key"},
+		{"acme.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\nacme_domains: [example.com]\n", "acme_cache: must be set with acme_domains"},
+		{"rate.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\nrate_limit: -1\n", "rate_limit: must not be negative"},
+		{"forwarded.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\nforwarded_header: X-Forwarded-For\n", "trusted_proxies: must be set with forwarded_header"},
+		{"trusted.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\nforwarded_header: X-Forwarded-For\ntrusted_proxies: [10.0.0.1]\n", "trusted_proxies[0]: "},
+		{"bandwidth.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\nbandwidth_down: 10X\n", "bandwidth_down: invalid rate \"10X\""},
+		{"websocket.yaml", "mode: client\nlisten: 127.0.0.1:1\nup: http://a/\nwebsocket: true\nresume: true\n", "websocket: does not support resume"},
+		{"credential.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\ncredentials:\n- name: a\n", "credentials[0].secret: must not be empty"},
+		{"credentials.yaml", "mode: server\nlisten: 127.0.0.1:1\nremote: 127.0.0.1:2\ncredentials:\n- name: a\n  secret: b\n- name: a\n  secret: c\n", `credentials[1].name: "a" already used by credentials[0]`},
+		{"names.yaml", "mode: server\nremote: 127.0.0.1:2\ntunnels:\n- name: a\n  listen: 127.0.0.1:1\n- name: a\n  listen: 127.0.0.1:3\n", `tunnels[1].name: "a" already used by tunnels[0]`},
+		{"udp.yaml", "tunnels:\n- mode: client\n  listen: 127.0.0.1:1\n  up: http://a/\n  down: http://a/\n  network: udp\n  mux: 2\n", "tunnels[0].mux: does not support udp"},
+	}
+
+	for _, test := range tests {
+		_, err := loadConfig(t, writeConfig(t, test.name, test.content))
+		if err == nil {
+			t.Fatal(test.name, "invalid config accepted")
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Fatal(test.name, "wrong error", err)
+		}
+	}
+}
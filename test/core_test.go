@@ -37,14 +37,38 @@ func sha256sum(b []byte) []byte {
 	return h.Sum(make([]byte, 0))
 }
 
+// wait until cond returns true, the test fails with what after 10 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // setup commonweb client and server
 //
 // closing the channel will stop commonweb client and server
 //
 // setupCommonweb also enables debug logging
 func setupCommonweb(t *testing.T, ch chan any) {
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:     "http://127.0.0.1:20010",
+		Down:   "http://127.0.0.1:20010",
+		Listen: "127.0.0.1:30010",
+		UTLS:   true,
+	}, server.Options{
+		Listen: "127.0.0.1:20010",
+		Remote: "127.0.0.1:30020",
+	})
+}
+
+// same as setupCommonweb, but with custom client and server options
+func setupCommonwebWithOptions(t *testing.T, ch chan any, clientOpts client.Options, serverOpts server.Options) {
 	// client
-	c := client.NewClient("http://127.0.0.1:20010", "http://127.0.0.1:20010", "127.0.0.1:30010", true, false)
+	c := client.NewClient(clientOpts)
 
 	go func() {
 		err := c.Start()
@@ -54,13 +78,17 @@ func setupCommonweb(t *testing.T, ch chan any) {
 		}
 	}()
 
+	var closed sync.WaitGroup
+	closed.Add(2)
+
 	go func() {
 		<-ch
 		c.Close()
+		closed.Done()
 	}()
 
 	// server
-	s := server.NewServer("127.0.0.1:20010", "127.0.0.1:30020")
+	s := server.NewServer(serverOpts)
 
 	go func() {
 		err := s.Start()
@@ -73,8 +101,12 @@ func setupCommonweb(t *testing.T, ch chan any) {
 	go func() {
 		<-ch
 		s.Close()
+		closed.Done()
 	}()
 
+	// the next test may listen on the same addresses
+	t.Cleanup(closed.Wait)
+
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		Level:     slog.LevelDebug,
 		AddSource: true,
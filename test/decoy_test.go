@@ -0,0 +1,187 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the body of the response to a request sent to url
+func decoyRequest(t *testing.T, method string, url string, header http.Header, body string) string {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal("new request", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("request", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("read body", err)
+	}
+	return string(b)
+}
+
+// the response to raw sent on a new connection to addr, until the server
+// closes it
+func rawRequest(t *testing.T, addr string, raw string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, raw)
+	if err != nil {
+		t.Fatal("write", err)
+	}
+
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal("read", raw, err)
+	}
+	return string(b)
+}
+
+// testing requests which are not tunnel requests served by a proxied
+// website, and by a directory after a reload
+func TestDecoy(t *testing.T) {
+	site, err := net.Listen("tcp", "127.0.0.1:30068")
+	if err != nil {
+		t.Fatal("listen", err)
+	}
+	defer site.Close()
+
+	go http.Serve(site, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "site "+r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("X-Probe")+" "+string(body))
+	}))
+
+	decoy, err := server.NewDecoy("http://127.0.0.1:30068")
+	if err != nil {
+		t.Fatal("new decoy", err)
+	}
+
+	opts := server.Options{
+		Listen: "127.0.0.1:20064",
+		Remote: "127.0.0.1:30069",
+		Secret: "decoy secret",
+		Decoy:  decoy,
+	}
+	s := server.NewServer(opts)
+	go s.Start()
+	defer s.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30069", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	tests := []struct {
+		method string
+		header http.Header
+		body   string
+		want   string
+	}{
+		{http.MethodGet, nil, "", "site GET /probe?a=1 yes "},
+		{http.MethodPost, nil, "form", "site POST /probe?a=1 yes form"},
+		{http.MethodPut, nil, "file", "site PUT /probe?a=1 yes file"},
+		{http.MethodPost, http.Header{"X-Session-Id": {"0123456789abcdef0"}}, "x", "site POST /probe?a=1 yes x"},
+		{http.MethodPost, http.Header{"X-Session-Id": {"abc"}, "X-Auth-Token": {"wrong"}}, "x", "site POST /probe?a=1 yes x"},
+	}
+	for _, test := range tests {
+		header := http.Header{"X-Probe": {"yes"}}
+		for key, values := range test.header {
+			header[key] = values
+		}
+
+		got := decoyRequest(t, test.method, "http://127.0.0.1:20064/probe?a=1", header, test.body)
+		if got != test.want {
+			t.Fatal("wrong decoy response", test.method, got)
+		}
+	}
+
+	// requests the server can not parse are answered by the decoy's http
+	// server, not by the tunnel
+	raws := []struct {
+		raw  string
+		want string
+	}{
+		{"GET /raw HTTP/1.1\r\nHost: h\r\nX-Probe: raw\r\nConnection: close\r\n\r\n", "site GET /raw raw "},
+		{"GET /raw HTTP/2.0\r\nHost: h\r\n\r\n", "505 HTTP Version Not Supported: unsupported protocol version"},
+		{"GET /raw\r\n\r\n", "400 Bad Request"},
+		{"GET /raw HTTP/1.1\r\nbad header\r\n\r\n", "400 Bad Request"},
+	}
+	for _, test := range raws {
+		got := rawRequest(t, "127.0.0.1:20064", test.raw)
+		if !strings.HasSuffix(got, test.want) || strings.Contains(got, "Cache-Control") {
+			t.Fatal("wrong decoy response", test.raw, got)
+		}
+	}
+
+	// tunnel requests are not passed to the decoy
+	for _, opts := range []client.Options{{}, {WebSocket: true}} {
+		opts.Up = "http://127.0.0.1:20064/"
+		opts.Down = "http://127.0.0.1:20064/"
+		opts.Secret = "decoy secret"
+
+		c := client.NewClient(opts)
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		conn, err := c.DialContext(ctx)
+		if err != nil {
+			t.Fatal("dial", opts, err)
+		}
+		defer conn.Close()
+
+		echoOnce(t, conn, 64*1024)
+	}
+
+	// serve a directory instead
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "index.html"), []byte("static site"), 0600)
+	if err != nil {
+		t.Fatal("write", err)
+	}
+
+	opts.Decoy, err = server.NewDecoy(dir)
+	if err != nil {
+		t.Fatal("new decoy", err)
+	}
+	err = s.Reload(opts)
+	if err != nil {
+		t.Fatal("reload", err)
+	}
+
+	http.DefaultClient.CloseIdleConnections()
+	got := decoyRequest(t, http.MethodGet, "http://127.0.0.1:20064/", nil, "")
+	if got != "static site" {
+		t.Fatal("wrong static response", got)
+	}
+
+	_, err = server.NewDecoy(filepath.Join(dir, "index.html"))
+	if err == nil {
+		t.Fatal("file accepted as a decoy directory")
+	}
+}
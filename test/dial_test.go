@@ -0,0 +1,115 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testing connections opened with DialContext, without a local listener
+func TestDialContext(t *testing.T) {
+	s := server.NewServer(server.Options{
+		Listen: "127.0.0.1:20055",
+		Remote: "127.0.0.1:30064",
+	})
+	go s.Start()
+	defer s.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30064", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	for _, mux := range []int{0, 2} {
+		c := client.NewClient(client.Options{
+			Up:   "http://127.0.0.1:20055",
+			Down: "http://127.0.0.1:20055",
+			Mux:  mux,
+		})
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		conn, err := c.DialContext(ctx)
+		if err != nil {
+			t.Fatal("dial", mux, err)
+		}
+		defer conn.Close()
+
+		echoOnce(t, conn, 64*1024)
+
+		// nothing is sent back before the deadline
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		_, err = conn.Read(make([]byte, 1))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("read deadline", mux, err)
+		}
+
+		echoOnce(t, conn, 1024)
+	}
+}
+
+// testing DialContext with a server which refuses the session
+func TestDialContextRefused(t *testing.T) {
+	s := server.NewServer(server.Options{
+		Listen: "127.0.0.1:20056",
+		Remote: "127.0.0.1:30065",
+		Secret: "server secret",
+	})
+	go s.Start()
+	defer s.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	c := client.NewClient(client.Options{
+		Up:     "http://127.0.0.1:20056",
+		Down:   "http://127.0.0.1:20056",
+		Secret: "wrong secret",
+	})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := c.DialContext(ctx)
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("session not refused", err)
+	}
+}
+
+// testing DialContext with a remote the server can not connect to
+func TestDialContextUnreachable(t *testing.T) {
+	s := server.NewServer(server.Options{
+		Listen: "127.0.0.1:20073",
+		Remote: "127.0.0.1:30084", // nothing listens
+	})
+	go s.Start()
+	defer s.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	c := client.NewClient(client.Options{
+		Up:   "http://127.0.0.1:20073",
+		Down: "http://127.0.0.1:20073",
+	})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := c.DialContext(ctx)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded without a remote")
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("dial not refused", err)
+	}
+}
@@ -0,0 +1,85 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testing the server mounted at a path of a net/http server, next to other
+// pages and behind a middleware
+func TestHandler(t *testing.T) {
+	s := server.NewServer(server.Options{
+		Remote: "127.0.0.1:30066",
+	})
+	defer s.Close()
+
+	var tunneled atomic.Int32
+	tunnel := s.Handler()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "site")
+	})
+	mux.Handle("/tunnel/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tunneled.Add(1)
+		tunnel.ServeHTTP(w, r)
+	}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:20058")
+	if err != nil {
+		t.Fatal("listen", err)
+	}
+	defer l.Close()
+
+	go http.Serve(l, mux)
+
+	var accepted atomic.Int32
+	echo := startEchoServer(t, "127.0.0.1:30066", &accepted)
+	defer echo.Close()
+
+	resp, err := http.Get("http://127.0.0.1:20058/")
+	if err != nil {
+		t.Fatal("get", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "site" {
+		t.Fatal("wrong page", string(body))
+	}
+
+	for _, opts := range []client.Options{
+		{},
+		{Mux: 2},
+		{WebSocket: true},
+		{Resume: true},
+		{UploadMode: "packet", DownloadMode: "poll"},
+	} {
+		opts.Up = "http://127.0.0.1:20058/tunnel/up"
+		opts.Down = "http://127.0.0.1:20058/tunnel/down"
+
+		c := client.NewClient(opts)
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		conn, err := c.DialContext(ctx)
+		if err != nil {
+			t.Fatal("dial", opts, err)
+		}
+		defer conn.Close()
+
+		echoOnce(t, conn, 256*1024)
+	}
+
+	if tunneled.Load() == 0 {
+		t.Fatal("requests did not pass the middleware")
+	}
+}
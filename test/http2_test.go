@@ -0,0 +1,204 @@
+package test
+
+import (
+	"bytes"
+	"commonweb2/client"
+	"commonweb2/server"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// return a self-signed certificate for 127.0.0.1
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generate key", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("create certificate", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+// a proxy terminating tls, the decrypted stream is relayed to target
+//
+// the protocols negotiated with ALPN are recorded
+type tlsProxy struct {
+	listener  net.Listener
+	protocols []string
+	sync.Mutex
+}
+
+func newTLSProxy(t *testing.T, listen string, target string, nextProtos []string) *tlsProxy {
+	l, err := tls.Listen("tcp", listen, &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert(t)},
+		NextProtos:   nextProtos,
+	})
+	if err != nil {
+		t.Fatal("proxy listen", err)
+	}
+
+	p := &tlsProxy{listener: l}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				tlsConn := conn.(*tls.Conn)
+				err := tlsConn.Handshake()
+				if err != nil {
+					return
+				}
+
+				p.Lock()
+				p.protocols = append(p.protocols, tlsConn.ConnectionState().NegotiatedProtocol)
+				p.Unlock()
+
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+
+				go func() {
+					io.Copy(upstream, conn)
+					upstream.Close()
+				}()
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return p
+}
+
+// return the protocols negotiated so far
+func (p *tlsProxy) negotiated() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string(nil), p.protocols...)
+}
+
+// send data through the tunnel and check the echo
+func testEcho(t *testing.T, listen string, size int) {
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	data := randomBytes(size)
+	go conn.Write(data)
+
+	received := make([]byte, size)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err = io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatal("read", err)
+	}
+
+	if !bytes.Equal(sha256sum(data), sha256sum(received)) {
+		t.Fatal("wrong hash")
+	}
+}
+
+// testing both requests of a session sent as http/2 streams over one utls
+// connection, to a server behind a proxy speaking h2 to it
+func TestHTTP2(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:         "https://127.0.0.1:20031",
+		Down:       "https://127.0.0.1:20031",
+		Listen:     "127.0.0.1:30030",
+		UTLS:       true,
+		SkipVerify: true,
+	}, server.Options{
+		Listen: "127.0.0.1:20030",
+		Remote: "127.0.0.1:30031",
+	})
+
+	proxy := newTLSProxy(t, "127.0.0.1:20031", "127.0.0.1:20030", []string{"h2", "http/1.1"})
+	defer proxy.listener.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30031", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testEcho(t, "127.0.0.1:30030", 4*1024*1024)
+	testEcho(t, "127.0.0.1:30030", 64*1024)
+
+	protocols := proxy.negotiated()
+	if len(protocols) != 1 || protocols[0] != "h2" {
+		t.Fatal("requests not sent over one h2 connection", protocols)
+	}
+}
+
+// testing the client falling back to http/1.1 if the server does not
+// negotiate h2
+func TestHTTP2Fallback(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:         "https://127.0.0.1:20033",
+		Down:       "https://127.0.0.1:20033",
+		Listen:     "127.0.0.1:30032",
+		UTLS:       true,
+		SkipVerify: true,
+	}, server.Options{
+		Listen: "127.0.0.1:20032",
+		Remote: "127.0.0.1:30033",
+	})
+
+	proxy := newTLSProxy(t, "127.0.0.1:20033", "127.0.0.1:20032", []string{"http/1.1"})
+	defer proxy.listener.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30033", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testEcho(t, "127.0.0.1:30032", 1024*1024)
+
+	for _, protocol := range proxy.negotiated() {
+		if protocol != "http/1.1" {
+			t.Fatal("unexpected protocol", protocol)
+		}
+	}
+}
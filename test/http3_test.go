@@ -0,0 +1,75 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// write a self-signed certificate for 127.0.0.1 and its key to files
+func writeCertFiles(t *testing.T) (string, string) {
+	cert := selfSignedCert(t)
+
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal("marshal key", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal("write certificate", err)
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal("write key", err)
+	}
+
+	return certFile, keyFile
+}
+
+// testing upload and download requests sent over http/3
+func TestHTTP3(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	certFile, keyFile := writeCertFiles(t)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:         "https://127.0.0.1:20035",
+		Down:       "https://127.0.0.1:20035",
+		Listen:     "127.0.0.1:30034",
+		SkipVerify: true,
+		HTTP3:      true,
+	}, server.Options{
+		Listen:   "127.0.0.1:20034",
+		Remote:   "127.0.0.1:30035",
+		H3Listen: "127.0.0.1:20035",
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30035", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testEcho(t, "127.0.0.1:30034", 4*1024*1024)
+	testEcho(t, "127.0.0.1:30034", 64*1024)
+
+	if accepted.Load() != 2 {
+		t.Fatal("wrong number of remote connections", accepted.Load())
+	}
+}
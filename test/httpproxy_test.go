@@ -0,0 +1,145 @@
+package test
+
+import (
+	"bufio"
+	"commonweb2/client"
+	"commonweb2/server"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testing http proxy inbound with CONNECT and absolute uri requests
+func TestHTTPProxy(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	allow, err := server.ParseAllowlist([]string{"127.0.0.0/8"}, []string{"30025", "30083"})
+	if err != nil {
+		t.Fatal("parse allowlist", err)
+	}
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:      "http://127.0.0.1:20014",
+		Down:    "http://127.0.0.1:20014",
+		Listen:  "127.0.0.1:30014",
+		Inbound: "http",
+	}, server.Options{
+		Listen: "127.0.0.1:20014",
+		Remote: "127.0.0.1:30022",
+		Allow:  allow,
+	})
+
+	// remote http server
+	l, err := net.Listen("tcp", "127.0.0.1:30025")
+	if err != nil {
+		t.Fatal("remote listen", err)
+	}
+	defer l.Close()
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.RequestURI)
+	}))
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	// absolute uri
+	proxy, _ := url.Parse("http://127.0.0.1:30014")
+	httpClient := http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxy)},
+	}
+
+	resp, err := httpClient.Get("http://127.0.0.1:30025/hello?a=b")
+	if err != nil {
+		t.Fatal("get", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("read body", err)
+	}
+	if string(body) != "GET /hello?a=b" {
+		t.Fatalf("unexpected response: %q", body)
+	}
+
+	// CONNECT
+	conn, err := net.Dial("tcp", "127.0.0.1:30014")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("CONNECT 127.0.0.1:30025 HTTP/1.1\r\nHost: 127.0.0.1:30025\r\n\r\n"))
+	if err != nil {
+		t.Fatal("write", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal("read response", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("CONNECT", resp.Status)
+	}
+
+	_, err = conn.Write([]byte("GET /tunnel HTTP/1.1\r\nHost: 127.0.0.1:30025\r\n\r\n"))
+	if err != nil {
+		t.Fatal("write", err)
+	}
+
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal("read response", err)
+	}
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("read body", err)
+	}
+	if string(body) != "GET /tunnel" {
+		t.Fatalf("unexpected response: %q", body)
+	}
+
+	// refused by the allowlist, nothing listens on the allowed 30083
+	for _, c := range []struct {
+		destination string
+		code        int
+	}{
+		{"127.0.0.1:30026", http.StatusForbidden},
+		{"127.0.0.1:30083", http.StatusBadGateway},
+	} {
+		conn, err := net.Dial("tcp", "127.0.0.1:30014")
+		if err != nil {
+			t.Fatal("dial", err)
+		}
+		defer conn.Close()
+
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", c.destination, c.destination)
+		if err != nil {
+			t.Fatal("write", err)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal("read response", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Fatalf("CONNECT %s: expected %d, got %s", c.destination, c.code, resp.Status)
+		}
+	}
+
+	resp, err = httpClient.Get("http://127.0.0.1:30026/hello")
+	if err != nil {
+		t.Fatal("get", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatal("expected 403, got", resp.Status)
+	}
+}
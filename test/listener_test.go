@@ -0,0 +1,65 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testing an http server serving the sessions handed out by Accept
+func TestServerListener(t *testing.T) {
+	s := server.NewServer(server.Options{
+		Listen: "127.0.0.1:20057",
+	})
+	go s.Start()
+	defer s.Close()
+
+	go http.Serve(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		io.WriteString(w, "hello "+host)
+	}))
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	for _, mux := range []int{0, 2} {
+		c := client.NewClient(client.Options{
+			Up:   "http://127.0.0.1:20057",
+			Down: "http://127.0.0.1:20057",
+			Mux:  mux,
+		})
+		defer c.Close()
+
+		httpClient := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return c.DialContext(ctx)
+				},
+			},
+			Timeout: time.Second * 10,
+		}
+
+		for i := 0; i < 3; i++ {
+			resp, err := httpClient.Get("http://commonweb2/")
+			if err != nil {
+				t.Fatal("get", mux, err)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal("read body", mux, err)
+			}
+
+			if string(body) != "hello 127.0.0.1" {
+				t.Fatal("wrong response", mux, string(body))
+			}
+		}
+
+		httpClient.CloseIdleConnections()
+	}
+}
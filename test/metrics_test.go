@@ -0,0 +1,128 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/metrics"
+	"commonweb2/server"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testing the counters of a session, and the text format
+func TestMetrics(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:     "http://127.0.0.1:20048",
+		Down:   "http://127.0.0.1:20048",
+		Listen: "127.0.0.1:30053",
+	}, server.Options{
+		Listen: "127.0.0.1:20048",
+		Remote: "127.0.0.1:30054",
+	})
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30054", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	up := metrics.ServerBytes.Value("up")
+	down := metrics.ServerBytes.Value("down")
+	ok := metrics.ServerResponses.Value("200")
+
+	conn, err := net.Dial("tcp", "127.0.0.1:30053")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	echoOnce(t, conn, 64*1024)
+
+	if metrics.ServerSessionsActive.Value() < 1 {
+		t.Fatal("session not counted as active")
+	}
+
+	conn.Close()
+	time.Sleep(time.Second) // wait for the session to end
+
+	if metrics.ServerBytes.Value("up")-up != 64*1024 || metrics.ServerBytes.Value("down")-down != 64*1024 {
+		t.Fatal("wrong byte counters", metrics.ServerBytes.Value("up")-up, metrics.ServerBytes.Value("down")-down)
+	}
+	if metrics.ServerResponses.Value("200")-ok != 2 {
+		t.Fatal("wrong number of responses", metrics.ServerResponses.Value("200")-ok)
+	}
+
+	var b strings.Builder
+	metrics.WriteText(&b)
+	for _, line := range []string{
+		"# TYPE commonweb2_server_bytes_total counter\n",
+		"commonweb2_server_bytes_total{direction=\"up\"} ",
+		"# TYPE commonweb2_server_sessions_active gauge\n",
+		"commonweb2_server_responses_total{code=\"200\"} ",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatal("missing line", line, b.String())
+		}
+	}
+}
+
+// testing failed requests of a client, and failed connections to remote
+func TestMetricsErrors(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	// nothing listens on the remote address
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:     "http://127.0.0.1:20049",
+		Down:   "http://127.0.0.1:20049",
+		Listen: "127.0.0.1:30055",
+	}, server.Options{
+		Listen: "127.0.0.1:20049",
+		Remote: "127.0.0.1:30056",
+	})
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	dialFailures := metrics.ServerDialFailures.Value()
+	requestErrors := metrics.ClientRequestErrors.Value("upload") + metrics.ClientRequestErrors.Value("download")
+
+	conn, err := net.Dial("tcp", "127.0.0.1:30055")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	conn.Read(make([]byte, 1))
+	conn.Close()
+
+	waitFor(t, "dial failure not counted", func() bool {
+		return metrics.ServerDialFailures.Value() > dialFailures
+	})
+
+	// a client whose server is down
+	c := client.NewClient(client.Options{
+		Up:     "http://127.0.0.1:20050",
+		Down:   "http://127.0.0.1:20050",
+		Listen: "127.0.0.1:30057",
+	})
+	go c.Start()
+	defer c.Close()
+
+	waitFor(t, "client not started", func() bool {
+		conn, err = net.Dial("tcp", "127.0.0.1:30057")
+		return err == nil
+	})
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	conn.Read(make([]byte, 1))
+	conn.Close()
+
+	// the request failing first cancels the other one, which is not counted
+	waitFor(t, "request error not counted", func() bool {
+		return metrics.ClientRequestErrors.Value("upload")+metrics.ClientRequestErrors.Value("download") > requestErrors
+	})
+}
@@ -0,0 +1,169 @@
+package test
+
+import (
+	"bytes"
+	"commonweb2/client"
+	"commonweb2/server"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// start an echo server, the number of accepted connections is counted
+func startEchoServer(t *testing.T, listen string, accepted *atomic.Int32) net.Listener {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatal("remote listen", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l
+}
+
+// send data over n connections at the same time and check the echo
+func testMuxEcho(t *testing.T, listen string, n int, size int) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			conn, err := net.Dial("tcp", listen)
+			if err != nil {
+				t.Error("dial", err)
+				return
+			}
+			defer conn.Close()
+
+			data := randomBytes(size)
+
+			// written slowly, so the streams are open at the same time
+			go func() {
+				for i := 0; i < size; i += 64 * 1024 {
+					_, err := conn.Write(data[i:min(i+64*1024, size)])
+					if err != nil {
+						return
+					}
+					time.Sleep(time.Millisecond * 5)
+				}
+			}()
+
+			received := make([]byte, size)
+			conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+			_, err = io.ReadFull(conn, received)
+			if err != nil {
+				t.Error("read", err)
+				return
+			}
+
+			if !bytes.Equal(sha256sum(data), sha256sum(received)) {
+				t.Error("wrong hash")
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// testing many connections carried by a pool of multiplexed sessions
+func TestMux(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:     "http://127.0.0.1:20018",
+		Down:   "http://127.0.0.1:20018",
+		Listen: "127.0.0.1:30018",
+		Mux:    2,
+	}, server.Options{
+		Listen: "127.0.0.1:20018",
+		Remote: "127.0.0.1:30028",
+	})
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30028", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testMuxEcho(t, "127.0.0.1:30018", 8, 1024*1024)
+
+	// the remote sees one connection per stream
+	if accepted.Load() != 8 {
+		t.Fatal("wrong number of remote connections", accepted.Load())
+	}
+
+	// the sessions are reused by later connections
+	testMuxEcho(t, "127.0.0.1:30018", 4, 64*1024)
+
+	if accepted.Load() != 12 {
+		t.Fatal("wrong number of remote connections", accepted.Load())
+	}
+}
+
+// testing multiplexed sessions surviving their connections being reset,
+// before the session is paired and while data flows
+func TestMuxResume(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:     "http://127.0.0.1:20029",
+		Down:   "http://127.0.0.1:20029",
+		Listen: "127.0.0.1:30019",
+		Mux:    1,
+		Resume: true,
+	}, server.Options{
+		Listen: "127.0.0.1:20019",
+		Remote: "127.0.0.1:30029",
+	})
+
+	proxy := newFlakyProxy(t, "127.0.0.1:20029", "127.0.0.1:20019")
+	defer proxy.Close()
+
+	// the first upload and download requests never reach the server
+	proxy.refuseNext(2)
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30029", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		testMuxEcho(t, "127.0.0.1:30019", 4, 4*1024*1024)
+	}()
+
+	// let data flow through the connections
+	waitFor(t, "no data relayed", func() bool {
+		return proxy.relayed.Load() > 1024*1024
+	})
+	proxy.reset()
+
+	<-done
+
+	if accepted.Load() != 4 {
+		t.Fatal("wrong number of remote connections", accepted.Load())
+	}
+}
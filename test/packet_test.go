@@ -0,0 +1,183 @@
+package test
+
+import (
+	"bytes"
+	"commonweb2/client"
+	"commonweb2/server"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a http proxy reading whole request bodies before forwarding them, like
+// some CDNs do. Responses are streamed, unless bufferResponses is set.
+func newBufferingProxy(t *testing.T, listen string, target string, bufferResponses bool) *http.Server {
+	transport := &http.Transport{}
+
+	proxy := &http.Server{
+		Addr: listen,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return
+			}
+
+			req, err := http.NewRequestWithContext(r.Context(), r.Method, "http://"+target+r.URL.Path, bytes.NewReader(body))
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			req.Header = r.Header.Clone()
+
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+
+			if bufferResponses {
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				w.Header().Del("Content-Length")
+				w.WriteHeader(resp.StatusCode)
+				w.Write(body)
+				return
+			}
+
+			w.WriteHeader(resp.StatusCode)
+
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := resp.Body.Read(buf)
+				if n > 0 {
+					w.Write(buf[:n])
+					http.NewResponseController(w).Flush()
+				}
+				if err != nil {
+					return
+				}
+			}
+		}),
+	}
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatal("proxy listen", err)
+	}
+	go proxy.Serve(l)
+
+	return proxy
+}
+
+// testing the upload sent as short requests through a proxy buffering
+// request bodies
+func TestPacketUpload(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:         "http://127.0.0.1:20040",
+		Down:       "http://127.0.0.1:20040",
+		Listen:     "127.0.0.1:30040",
+		UploadMode: "packet",
+	}, server.Options{
+		Listen: "127.0.0.1:20039",
+		Remote: "127.0.0.1:30041",
+	})
+
+	proxy := newBufferingProxy(t, "127.0.0.1:20040", "127.0.0.1:20039", false)
+	defer proxy.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30041", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testEcho(t, "127.0.0.1:30040", 4*1024*1024)
+	testMuxEcho(t, "127.0.0.1:30040", 4, 512*1024)
+
+	if accepted.Load() != 5 {
+		t.Fatal("wrong number of remote connections", accepted.Load())
+	}
+}
+
+// the response of a packet upload of the session id, or of a poll if cursor
+// is set, its body is closed
+func packetRequest(t *testing.T, url string, id string, seq string, cursor string) *http.Response {
+	method := http.MethodPost
+	if cursor != "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal("new request", err)
+	}
+	req.Header.Set("X-Session-Id", id)
+	req.Header.Set("X-Upload", "packet")
+	req.Header.Set("X-Download", "poll")
+	if seq != "" {
+		req.Header.Set("X-Seq", seq)
+	}
+	if cursor != "" {
+		req.Header.Set("X-Cursor", cursor)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("request", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// testing that only the first packet or poll of a session creates it, and
+// that caches may not store the responses
+func TestPacketUnknownSession(t *testing.T) {
+	s := server.NewServer(server.Options{
+		Listen:      "127.0.0.1:20067",
+		Remote:      "127.0.0.1:30072",
+		MaxSessions: 1,
+	})
+	go s.Start()
+	defer s.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30072", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	// late requests of sessions which are not known do not take the only
+	// session of the address
+	if code := packetRequest(t, "http://127.0.0.1:20067/", "late1", "3", "").StatusCode; code != http.StatusGone {
+		t.Fatal("late packet not refused", code)
+	}
+	if code := packetRequest(t, "http://127.0.0.1:20067/", "late2", "", "1024").StatusCode; code != http.StatusGone {
+		t.Fatal("late poll not refused", code)
+	}
+
+	for i, resp := range []*http.Response{
+		packetRequest(t, "http://127.0.0.1:20067/", "first", "0", ""),
+		packetRequest(t, "http://127.0.0.1:20067/", "first", "1", ""),
+		packetRequest(t, "http://127.0.0.1:20067/?c=0", "first", "", "0"),
+	} {
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("request of the session refused", i, resp.StatusCode)
+		}
+		if resp.Header.Get("Cache-Control") != server.CACHE_CONTROL {
+			t.Fatal("response may be cached", i, resp.Header.Get("Cache-Control"))
+		}
+	}
+}
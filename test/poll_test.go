@@ -0,0 +1,67 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testing the download received with polls through a proxy buffering both
+// requests and responses
+func TestPollDownload(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:           "http://127.0.0.1:20042",
+		Down:         "http://127.0.0.1:20042",
+		Listen:       "127.0.0.1:30042",
+		UploadMode:   "packet",
+		DownloadMode: "poll",
+	}, server.Options{
+		Listen: "127.0.0.1:20041",
+		Remote: "127.0.0.1:30043",
+	})
+
+	proxy := newBufferingProxy(t, "127.0.0.1:20042", "127.0.0.1:20041", true)
+	defer proxy.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30043", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testEcho(t, "127.0.0.1:30042", 4*1024*1024)
+	testMuxEcho(t, "127.0.0.1:30042", 4, 512*1024)
+
+	if accepted.Load() != 5 {
+		t.Fatal("wrong number of remote connections", accepted.Load())
+	}
+}
+
+// testing the download received with polls while the upload is streamed
+func TestPollDownloadStreamUpload(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:           "http://127.0.0.1:20043",
+		Down:         "http://127.0.0.1:20043",
+		Listen:       "127.0.0.1:30044",
+		DownloadMode: "poll",
+	}, server.Options{
+		Listen: "127.0.0.1:20043",
+		Remote: "127.0.0.1:30045",
+	})
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30045", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testEcho(t, "127.0.0.1:30044", 1024*1024)
+}
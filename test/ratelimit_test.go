@@ -0,0 +1,183 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the status code of a request which is not a tunnel request, sent from
+// forwarded if it is not empty
+func limitedRequest(t *testing.T, url string, forwarded string) int {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal("new request", err)
+	}
+	if forwarded != "" {
+		req.Header.Set("X-Forwarded-For", "192.0.2.1, "+forwarded)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("request", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// testing the limits of requests and concurrent sessions per client address
+func TestRateLimit(t *testing.T) {
+	opts := server.Options{
+		Listen:          "127.0.0.1:20065",
+		Remote:          "127.0.0.1:30070",
+		RateLimit:       1,
+		RateBurst:       3,
+		ForwardedHeader: "X-Forwarded-For",
+		TrustedProxies:  []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}
+	s := server.NewServer(opts)
+	go s.Start()
+	defer s.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30070", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	for i := 0; i < 3; i++ {
+		code := limitedRequest(t, "http://127.0.0.1:20065/", "10.0.0.1")
+		if code != http.StatusBadRequest {
+			t.Fatal("request within the burst refused", i, code)
+		}
+	}
+	if code := limitedRequest(t, "http://127.0.0.1:20065/", "10.0.0.1"); code != http.StatusTooManyRequests {
+		t.Fatal("request over the limit not refused", code)
+	}
+
+	// other addresses have their own tokens, including the source address
+	// of requests without the header
+	if code := limitedRequest(t, "http://127.0.0.1:20065/", "10.0.0.2"); code != http.StatusBadRequest {
+		t.Fatal("request of another address refused", code)
+	}
+	if code := limitedRequest(t, "http://127.0.0.1:20065/", ""); code != http.StatusBadRequest {
+		t.Fatal("request without forwarded address refused", code)
+	}
+
+	time.Sleep(1100 * time.Millisecond) // refill one token
+	if code := limitedRequest(t, "http://127.0.0.1:20065/", "10.0.0.1"); code != http.StatusBadRequest {
+		t.Fatal("request after refill refused", code)
+	}
+
+	// only the request creating a session is charged, not its packets
+	// and polls
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:20065/", strings.NewReader("x"))
+		if err != nil {
+			t.Fatal("new request", err)
+		}
+		req.Header.Set("X-Session-Id", "packets")
+		req.Header.Set("X-Upload", "packet")
+		req.Header.Set("X-Download", "poll")
+		req.Header.Set("X-Seq", strconv.Itoa(i))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("packet", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("packet of a session refused", i, resp.StatusCode)
+		}
+
+		// the echoed byte
+		resp = packetRequest(t, "http://127.0.0.1:20065/?c="+strconv.Itoa(i), "packets", "", strconv.Itoa(i))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("poll of a session refused", i, resp.StatusCode)
+		}
+	}
+
+	// one session per address
+	opts.RateLimit = 0
+	opts.MaxSessions = 1
+	err := s.Reload(opts)
+	if err != nil {
+		t.Fatal("reload", err)
+	}
+
+	c := client.NewClient(client.Options{
+		Up:   "http://127.0.0.1:20065/",
+		Down: "http://127.0.0.1:20065/",
+	})
+	defer c.Close()
+
+	dial := func() (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		return c.DialContext(ctx)
+	}
+
+	conn, err := dial()
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	echoOnce(t, conn, 1024)
+
+	second, err := dial()
+	if err == nil {
+		second.Close()
+		t.Fatal("session over the limit accepted")
+	}
+
+	// the session is released once it ends
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err = dial()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session not released", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer conn.Close()
+
+	echoOnce(t, conn, 1024)
+}
+
+// testing the forwarded header is ignored when the request is not received
+// from a trusted proxy
+func TestForwardedUntrusted(t *testing.T) {
+	s := server.NewServer(server.Options{
+		Listen:          "127.0.0.1:20071",
+		Remote:          "127.0.0.1:30079",
+		RateLimit:       1,
+		RateBurst:       1,
+		ForwardedHeader: "X-Forwarded-For",
+		TrustedProxies:  []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	})
+	go s.Start()
+	defer s.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	if code := limitedRequest(t, "http://127.0.0.1:20071/", "10.0.0.1"); code != http.StatusBadRequest {
+		t.Fatal("request within the burst refused", code)
+	}
+
+	// both requests are counted for the source address
+	if code := limitedRequest(t, "http://127.0.0.1:20071/", "10.0.0.2"); code != http.StatusTooManyRequests {
+		t.Fatal("forwarded address of an untrusted peer used", code)
+	}
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"bytes"
+	"commonweb2/client"
+	"commonweb2/server"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// send data over conn and check the echo
+func echoOnce(t *testing.T, conn net.Conn, size int) {
+	data := randomBytes(size)
+	go conn.Write(data)
+
+	received := make([]byte, size)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err := io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatal("read", err)
+	}
+
+	if !bytes.Equal(data, received) {
+		t.Fatal("wrong data")
+	}
+}
+
+// testing a reload changing the remote and rotating the secret, while a
+// session started before the reload keeps running
+func TestReload(t *testing.T) {
+	clientOpts := client.Options{
+		Up:           "http://127.0.0.1:20046",
+		Down:         "http://127.0.0.1:20046",
+		Listen:       "127.0.0.1:30050",
+		Secret:       "old secret",
+		UploadMode:   "packet",
+		DownloadMode: "poll",
+	}
+	serverOpts := server.Options{
+		Listen: "127.0.0.1:20046",
+		Remote: "127.0.0.1:30051",
+		Secret: "old secret",
+	}
+
+	c := client.NewClient(clientOpts)
+	go c.Start()
+	defer c.Close()
+
+	s := server.NewServer(serverOpts)
+	go s.Start()
+	defer s.Close()
+
+	var acceptedOld, acceptedNew atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30051", &acceptedOld)
+	defer l.Close()
+	l2 := startEchoServer(t, "127.0.0.1:30052", &acceptedNew)
+	defer l2.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	conn, err := net.Dial("tcp", "127.0.0.1:30050")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	echoOnce(t, conn, 64*1024)
+
+	clientOpts.Secret = "new secret"
+	serverOpts.Secret = "new secret"
+	serverOpts.Remote = "127.0.0.1:30052"
+
+	err = s.Reload(serverOpts)
+	if err != nil {
+		t.Fatal("reload server", err)
+	}
+	err = c.Reload(clientOpts)
+	if err != nil {
+		t.Fatal("reload client", err)
+	}
+
+	// the old session still sends packets and polls with the old secret
+	echoOnce(t, conn, 256*1024)
+
+	testEcho(t, "127.0.0.1:30050", 64*1024)
+
+	if acceptedOld.Load() != 1 || acceptedNew.Load() != 1 {
+		t.Fatal("wrong number of remote connections", acceptedOld.Load(), acceptedNew.Load())
+	}
+
+	serverOpts.Listen = "127.0.0.1:20047"
+	if s.Reload(serverOpts) == nil {
+		t.Fatal("listen address reloaded")
+	}
+}
@@ -0,0 +1,202 @@
+package test
+
+import (
+	"bytes"
+	"commonweb2/client"
+	"commonweb2/server"
+	"crypto"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a tcp relay whose connections can be reset at any time
+type flakyProxy struct {
+	listener net.Listener
+	conns    []net.Conn
+	refuse   int          // connections to reset before they reach the target
+	relayed  atomic.Int64 // bytes relayed from the target
+	sync.Mutex
+}
+
+// counts the bytes written to it
+type countWriter struct {
+	n *atomic.Int64
+}
+
+func (w countWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func newFlakyProxy(t *testing.T, listen string, target string) *flakyProxy {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatal("proxy listen", err)
+	}
+
+	p := &flakyProxy{listener: l}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			p.Lock()
+			refuse := p.refuse > 0
+			if refuse {
+				p.refuse--
+			}
+			p.Unlock()
+
+			if refuse {
+				conn.(*net.TCPConn).SetLinger(0)
+				conn.Close()
+				continue
+			}
+
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+
+			p.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.Unlock()
+
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.Close()
+			}()
+			go func() {
+				io.Copy(io.MultiWriter(conn, countWriter{&p.relayed}), upstream)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return p
+}
+
+// reset the next n connections before they reach the target
+func (p *flakyProxy) refuseNext(n int) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.refuse = n
+}
+
+// reset all connections relayed so far
+func (p *flakyProxy) reset() {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, conn := range p.conns {
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *flakyProxy) Close() error {
+	p.reset()
+	return p.listener.Close()
+}
+
+// testing a session survives its connections being reset
+func TestResume(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:     "http://127.0.0.1:20017",
+		Down:   "http://127.0.0.1:20017",
+		Listen: "127.0.0.1:30016",
+		Resume: true,
+	}, server.Options{
+		Listen: "127.0.0.1:20016",
+		Remote: "127.0.0.1:30027",
+	})
+
+	proxy := newFlakyProxy(t, "127.0.0.1:20017", "127.0.0.1:20016")
+	defer proxy.Close()
+
+	// echo server
+	l, err := net.Listen("tcp", "127.0.0.1:30027")
+	if err != nil {
+		t.Fatal("remote listen", err)
+	}
+	defer l.Close()
+
+	remoteDone := make(chan struct{})
+	go func() {
+		defer close(remoteDone)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	conn, err := net.Dial("tcp", "127.0.0.1:30016")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	write := crypto.SHA256.New()
+	read := crypto.SHA256.New()
+
+	const total = 4 * 1024 * 1024
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+		_, err := io.CopyN(read, conn, total)
+		if err != nil {
+			t.Error("read", err)
+		}
+	}()
+
+	for i := 0; i < total/(64*1024); i++ {
+		buf := randomBytes(64 * 1024)
+		write.Write(buf)
+
+		_, err = conn.Write(buf)
+		if err != nil {
+			t.Fatal("write", err)
+		}
+
+		if i == 16 || i == 40 {
+			time.Sleep(time.Millisecond * 300) // let data flow through the connections
+			proxy.reset()
+		}
+	}
+
+	wg.Wait()
+
+	if !bytes.Equal(read.Sum(nil), write.Sum(nil)) {
+		t.Fatal("wrong hash")
+	}
+
+	// the end of the stream reaches the remote
+	conn.Close()
+
+	select {
+	case <-remoteDone:
+	case <-time.After(time.Second * 5):
+		t.Fatal("remote connection not closed")
+	}
+}
@@ -0,0 +1,187 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wait for the local connection to be closed
+func expectClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("connection not closed", err)
+	}
+}
+
+// testing a server shutdown, which refuses new sessions and waits for the
+// active one to end
+func TestServerShutdown(t *testing.T) {
+	c := client.NewClient(client.Options{
+		Up:     "http://127.0.0.1:20053",
+		Down:   "http://127.0.0.1:20053",
+		Listen: "127.0.0.1:30060",
+	})
+	go c.Start()
+	defer c.Close()
+
+	s := server.NewServer(server.Options{
+		Listen: "127.0.0.1:20053",
+		Remote: "127.0.0.1:30061",
+	})
+	go s.Start()
+	defer s.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30061", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	conn, err := net.Dial("tcp", "127.0.0.1:30060")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	echoOnce(t, conn, 64*1024)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	time.Sleep(time.Second) // wait for the server to stop listening
+
+	// the active session keeps working
+	echoOnce(t, conn, 64*1024)
+
+	_, err = net.Dial("tcp", "127.0.0.1:20053")
+	if err == nil {
+		t.Fatal("server still accepts connections")
+	}
+
+	select {
+	case err := <-done:
+		t.Fatal("shutdown returned with an active session", err)
+	default:
+	}
+
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("shutdown", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("shutdown did not return after the session ended")
+	}
+}
+
+// testing a client shutdown whose deadline passes before the active session
+// ends
+func TestClientShutdownDeadline(t *testing.T) {
+	c := client.NewClient(client.Options{
+		Up:     "http://127.0.0.1:20054",
+		Down:   "http://127.0.0.1:20054",
+		Listen: "127.0.0.1:30062",
+	})
+	go c.Start()
+	defer c.Close()
+
+	s := server.NewServer(server.Options{
+		Listen: "127.0.0.1:20054",
+		Remote: "127.0.0.1:30063",
+	})
+	go s.Start()
+	defer s.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30063", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	conn, err := net.Dial("tcp", "127.0.0.1:30062")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	echoOnce(t, conn, 64*1024)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Shutdown(ctx)
+	}()
+
+	time.Sleep(time.Second) // wait for the client to stop listening
+
+	echoOnce(t, conn, 64*1024)
+
+	_, err = net.Dial("tcp", "127.0.0.1:30062")
+	if err == nil {
+		t.Fatal("client still accepts connections")
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("wrong shutdown error", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("shutdown did not return at the deadline")
+	}
+
+	expectClosed(t, conn)
+}
+
+// testing a server and a client shut down before they start, which must not
+// listen afterwards
+func TestShutdownBeforeStart(t *testing.T) {
+	s := server.NewServer(server.Options{
+		Listen: "127.0.0.1:20068",
+		Remote: "127.0.0.1:30073",
+	})
+	c := client.NewClient(client.Options{
+		Up:     "http://127.0.0.1:20068",
+		Down:   "http://127.0.0.1:20068",
+		Listen: "127.0.0.1:30074",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal("server shutdown", err)
+	}
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal("client shutdown", err)
+	}
+
+	if err := s.Start(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("server started after shutdown", err)
+	}
+	if err := c.Start(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("client started after shutdown", err)
+	}
+
+	for _, addr := range []string{"127.0.0.1:20068", "127.0.0.1:30074"} {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal("address still in use", addr, err)
+		}
+		l.Close()
+	}
+}
@@ -0,0 +1,327 @@
+package test
+
+import (
+	"bytes"
+	"commonweb2/client"
+	"commonweb2/server"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connect to a socks5 proxy and request host:port
+func dialSocks5(proxy string, host string, port uint16) (net.Conn, error) {
+	conn, rep, err := socks5Request(proxy, host, port)
+	if err != nil {
+		return nil, err
+	}
+	if rep != 0x00 {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 request failed: %d", rep)
+	}
+	return conn, nil
+}
+
+// connect to a socks5 proxy, request host:port and return the reply code
+func socks5Request(proxy string, host string, port uint16) (net.Conn, byte, error) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	request := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(request, 0x01)
+		request = append(request, ip.To4()...)
+	} else if ip != nil {
+		request = append(request, 0x04)
+		request = append(request, ip.To16()...)
+	} else {
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, port)
+
+	_, err = conn.Write(request)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+
+	reply := make([]byte, 2+10)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+
+	if !bytes.Equal(reply[:3], []byte{0x05, 0x00, 0x05}) || reply[4] != 0x00 {
+		conn.Close()
+		return nil, 0, fmt.Errorf("socks5 handshake failed: %x", reply)
+	}
+
+	return conn, reply[3], nil
+}
+
+func setupSocks5(t *testing.T, ch chan any) {
+	allow, err := server.ParseAllowlist([]string{"127.0.0.0/8"}, []string{"30023"})
+	if err != nil {
+		t.Fatal("parse allowlist", err)
+	}
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:      "http://127.0.0.1:20013",
+		Down:    "http://127.0.0.1:20013",
+		Listen:  "127.0.0.1:30013",
+		Inbound: "socks5",
+	}, server.Options{
+		Listen: "127.0.0.1:20013",
+		Remote: "127.0.0.1:30022",
+		Allow:  allow,
+	})
+}
+
+// testing socks5 inbound with ipv4 and domain name destinations
+func TestSocks5(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupSocks5(t, ch)
+
+	l, err := net.Listen("tcp", "127.0.0.1:30023")
+	if err != nil {
+		t.Fatal("remote listen", err)
+	}
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		testDate := randomBytes(4096)
+
+		conn, err := dialSocks5("127.0.0.1:30013", host, 30023)
+		if err != nil {
+			t.Fatal("dial socks5", host, err)
+		}
+
+		_, err = conn.Write(testDate)
+		if err != nil {
+			t.Fatal("write", err)
+		}
+
+		remote, err := l.Accept()
+		if err != nil {
+			t.Fatal("remote accept", err)
+		}
+
+		received := make([]byte, 4096)
+		_, err = io.ReadFull(remote, received)
+		if err != nil {
+			t.Fatal("remote readfull", err)
+		}
+
+		if !bytes.Equal(received, testDate) {
+			t.Fatal("received wrong data")
+		}
+
+		// echo back
+		_, err = remote.Write(received)
+		if err != nil {
+			t.Fatal("remote write", err)
+		}
+
+		_, err = io.ReadFull(conn, received)
+		if err != nil {
+			t.Fatal("readfull", err)
+		}
+
+		if !bytes.Equal(received, testDate) {
+			t.Fatal("received wrong data")
+		}
+
+		remote.Close()
+		conn.Close()
+	}
+}
+
+// testing destinations outside the allowlist are refused with a reply
+func TestSocks5NotAllowed(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupSocks5(t, ch)
+
+	l, err := net.Listen("tcp", "127.0.0.1:30024")
+	if err != nil {
+		t.Fatal("remote listen", err)
+	}
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	conn, rep, err := socks5Request("127.0.0.1:30013", "127.0.0.1", 30024)
+	if err != nil {
+		t.Fatal("socks5 request", err)
+	}
+	defer conn.Close()
+
+	if rep != 0x02 {
+		t.Fatal("wrong reply", rep)
+	}
+
+	// the connection is closed after the reply
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	remote, err := l.Accept()
+	if err == nil {
+		remote.Close()
+		t.Fatal("remote accepted a connection to a destination not allowed")
+	}
+}
+
+// testing an allowed destination which can not be reached is reported in
+// the reply
+func TestSocks5Unreachable(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupSocks5(t, ch)
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	// nothing listens on the allowed port
+	conn, rep, err := socks5Request("127.0.0.1:30013", "127.0.0.1", 30023)
+	if err != nil {
+		t.Fatal("socks5 request", err)
+	}
+	defer conn.Close()
+
+	if rep != 0x04 {
+		t.Fatal("wrong reply", rep)
+	}
+}
+
+// testing an allowlist of ports only does not allow loopback, private or
+// multicast addresses
+func TestSocks5PortsOnly(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	allow, err := server.ParseAllowlist(nil, []string{"30076"})
+	if err != nil {
+		t.Fatal("parse allowlist", err)
+	}
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:      "http://127.0.0.1:20070",
+		Down:    "http://127.0.0.1:20070",
+		Listen:  "127.0.0.1:30077",
+		Inbound: "socks5",
+	}, server.Options{
+		Listen: "127.0.0.1:20070",
+		Remote: "127.0.0.1:30022",
+		Allow:  allow,
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:30076")
+	if err != nil {
+		t.Fatal("remote listen", err)
+	}
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	for _, host := range []string{"127.0.0.1", "localhost", "::1", "10.0.0.1", "192.168.1.1", "fd00::1", "224.0.0.1"} {
+		conn, rep, err := socks5Request("127.0.0.1:30077", host, 30076)
+		if err != nil {
+			t.Fatal("socks5 request", host, err)
+		}
+		conn.Close()
+
+		if rep != 0x02 {
+			t.Fatal("wrong reply", host, rep)
+		}
+	}
+}
+
+// testing the reply of streams of multiplexed sessions waits for the server
+// to connect the destination
+func TestSocks5Mux(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	allow, err := server.ParseAllowlist([]string{"127.0.0.0/8"}, []string{"30081"})
+	if err != nil {
+		t.Fatal("parse allowlist", err)
+	}
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:      "http://127.0.0.1:20072",
+		Down:    "http://127.0.0.1:20072",
+		Listen:  "127.0.0.1:30080",
+		Inbound: "socks5",
+		Mux:     2,
+	}, server.Options{
+		Listen: "127.0.0.1:20072",
+		Remote: "127.0.0.1:30022",
+		Allow:  allow,
+	})
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	tests := []struct {
+		port uint16
+		want byte
+	}{
+		{30082, 0x02}, // not allowed
+		{30081, 0x04}, // nothing listens on the allowed port
+	}
+	for _, test := range tests {
+		conn, rep, err := socks5Request("127.0.0.1:30080", "127.0.0.1", test.port)
+		if err != nil {
+			t.Fatal("socks5 request", test.port, err)
+		}
+		conn.Close()
+
+		if rep != test.want {
+			t.Fatal("wrong reply", test.port, rep)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:30081")
+	if err != nil {
+		t.Fatal("remote listen", err)
+	}
+	defer l.Close()
+
+	conn, err := dialSocks5("127.0.0.1:30080", "127.0.0.1", 30081)
+	if err != nil {
+		t.Fatal("dial socks5", err)
+	}
+	defer conn.Close()
+
+	remote, err := l.Accept()
+	if err != nil {
+		t.Fatal("remote accept", err)
+	}
+	defer remote.Close()
+
+	_, err = remote.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal("remote write", err)
+	}
+
+	received := make([]byte, 5)
+	_, err = io.ReadFull(conn, received)
+	if err != nil || string(received) != "hello" {
+		t.Fatal("readfull", err, received)
+	}
+}
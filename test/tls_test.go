@@ -0,0 +1,108 @@
+package test
+
+import (
+	"bytes"
+	"commonweb2/client"
+	"commonweb2/server"
+	"context"
+	"crypto/tls"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the certificate served on addr, and the negotiated protocol
+func dialTLS(t *testing.T, addr string, nextProtos []string) ([]byte, string) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         nextProtos,
+	})
+	if err != nil {
+		t.Fatal("dial tls", err)
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	return state.PeerCertificates[0].Raw, state.NegotiatedProtocol
+}
+
+// testing sessions over a server terminating tls, and reloading its
+// certificate when the files change
+func TestServerTLS(t *testing.T) {
+	certFile, keyFile := writeCertFiles(t)
+
+	s := server.NewServer(server.Options{
+		Listen:   "127.0.0.1:20059",
+		Remote:   "127.0.0.1:30067",
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		TLS:      true,
+	})
+	go s.Start()
+	defer s.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30067", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for the server to start
+
+	_, proto := dialTLS(t, "127.0.0.1:20059", []string{"h2", "http/1.1"})
+	if proto != "h2" {
+		t.Fatal("h2 not negotiated", proto)
+	}
+	first, proto := dialTLS(t, "127.0.0.1:20059", []string{"http/1.1"})
+	if proto != "http/1.1" {
+		t.Fatal("http/1.1 not negotiated", proto)
+	}
+
+	for _, opts := range []client.Options{
+		{},
+		{UTLS: true},
+		{WebSocket: true},
+		{Mux: 2},
+	} {
+		opts.Up = "https://127.0.0.1:20059/"
+		opts.Down = "https://127.0.0.1:20059/"
+		opts.SkipVerify = true
+
+		c := client.NewClient(opts)
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		conn, err := c.DialContext(ctx)
+		if err != nil {
+			t.Fatal("dial", opts, err)
+		}
+		defer conn.Close()
+
+		echoOnce(t, conn, 256*1024)
+	}
+
+	// replace the certificate
+	newCertFile, newKeyFile := writeCertFiles(t)
+	for _, file := range [][2]string{{newCertFile, certFile}, {newKeyFile, keyFile}} {
+		b, err := os.ReadFile(file[0])
+		if err != nil {
+			t.Fatal("read", err)
+		}
+		err = os.WriteFile(file[1], b, 0600)
+		if err != nil {
+			t.Fatal("write", err)
+		}
+
+		// the files may be written within the resolution of their
+		// modification time
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(file[1], later, later)
+	}
+
+	// the files are checked once per interval
+	waitFor(t, "certificate not reloaded", func() bool {
+		second, _ := dialTLS(t, "127.0.0.1:20059", []string{"http/1.1"})
+		return !bytes.Equal(first, second)
+	})
+}
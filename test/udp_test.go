@@ -0,0 +1,82 @@
+package test
+
+import (
+	"bytes"
+	"commonweb2/client"
+	"commonweb2/server"
+	"net"
+	"testing"
+	"time"
+)
+
+// testing udp forwarding with an echo server as remote
+func TestUDP(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:         "http://127.0.0.1:20015",
+		Down:       "http://127.0.0.1:20015",
+		Listen:     "127.0.0.1:30015",
+		Network:    "udp",
+		UDPTimeout: time.Second * 2,
+	}, server.Options{
+		Listen: "127.0.0.1:20015",
+		Remote: "127.0.0.1:30026",
+	})
+
+	// udp echo server
+	remote, err := net.ListenPacket("udp", "127.0.0.1:30026")
+	if err != nil {
+		t.Fatal("remote listen", err)
+	}
+	defer remote.Close()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := remote.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			remote.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	conn, err := net.Dial("udp", "127.0.0.1:30015")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	echo := func() {
+		for _, length := range []int{1, 100, 1400, 8000} {
+			testDate := randomBytes(length)
+
+			_, err = conn.Write(testDate)
+			if err != nil {
+				t.Fatal("write", err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			received := make([]byte, 65535)
+			n, err := conn.Read(received)
+			if err != nil {
+				t.Fatal("read", err)
+			}
+
+			if !bytes.Equal(received[:n], testDate) {
+				t.Fatal("received wrong data")
+			}
+		}
+	}
+
+	echo()
+
+	// the association expires and a new session is created
+	time.Sleep(time.Second * 4)
+
+	echo()
+}
@@ -0,0 +1,73 @@
+package test
+
+import (
+	"commonweb2/client"
+	"commonweb2/server"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testing sessions carried by websocket connections
+func TestWebSocket(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:        "ws://127.0.0.1:20036",
+		Down:      "ws://127.0.0.1:20036",
+		Listen:    "127.0.0.1:30036",
+		WebSocket: true,
+	}, server.Options{
+		Listen: "127.0.0.1:20036",
+		Remote: "127.0.0.1:30037",
+	})
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30037", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testEcho(t, "127.0.0.1:30036", 4*1024*1024)
+	testMuxEcho(t, "127.0.0.1:30036", 4, 256*1024)
+
+	if accepted.Load() != 5 {
+		t.Fatal("wrong number of remote connections", accepted.Load())
+	}
+}
+
+// testing websocket over utls, which must not offer h2
+func TestWebSocketUTLS(t *testing.T) {
+	ch := make(chan any)
+	defer close(ch)
+
+	setupCommonwebWithOptions(t, ch, client.Options{
+		Up:         "wss://127.0.0.1:20038",
+		Down:       "wss://127.0.0.1:20038",
+		Listen:     "127.0.0.1:30038",
+		WebSocket:  true,
+		UTLS:       true,
+		SkipVerify: true,
+		Mux:        1,
+	}, server.Options{
+		Listen: "127.0.0.1:20037",
+		Remote: "127.0.0.1:30039",
+	})
+
+	proxy := newTLSProxy(t, "127.0.0.1:20038", "127.0.0.1:20037", []string{"h2", "http/1.1"})
+	defer proxy.listener.Close()
+
+	var accepted atomic.Int32
+	l := startEchoServer(t, "127.0.0.1:30039", &accepted)
+	defer l.Close()
+
+	time.Sleep(time.Second) // wait for client and server to start
+
+	testMuxEcho(t, "127.0.0.1:30038", 4, 1024*1024)
+
+	protocols := proxy.negotiated()
+	if len(protocols) != 1 || protocols[0] != "http/1.1" {
+		t.Fatal("unexpected protocols", protocols)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"commonweb2/admin"
+	"commonweb2/client"
+	"commonweb2/config"
+	"commonweb2/server"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// how long a removed tunnel may take to stop listening before the tunnels
+// of the new configuration are started anyway
+const STOP_TIMEOUT = 10 * time.Second
+
+// a client or server started by main
+type tunnel struct {
+	config   config.Tunnel
+	reload   func(t config.Tunnel) error     // apply new options to new sessions
+	shutdown func(ctx context.Context) error // stop listening and drain sessions
+	stopped  chan struct{}                   // closed when the tunnel stops listening
+
+	sessions admin.Source // nil for clients
+}
+
+// tunnelSet runs the tunnels of the configuration
+//
+// a tunnel which fails does not stop the others
+type tunnelSet struct {
+	running map[string]*tunnel // by listen key
+	wg      sync.WaitGroup     // running and removed tunnels, and calls of apply
+	closing bool               // set by shutdown, no tunnel is started after it
+
+	// removed tunnels drain their sessions until the process shuts down
+	draining     context.Context
+	stopDraining context.CancelFunc
+
+	applyMu sync.Mutex // one call of apply at a time
+	sync.Mutex
+}
+
+func newTunnelSet() *tunnelSet {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &tunnelSet{
+		running:      make(map[string]*tunnel),
+		draining:     ctx,
+		stopDraining: cancel,
+	}
+}
+
+// apply starts the tunnels of list which are not running, reloads running
+// tunnels whose options have changed, and shuts down running tunnels missing
+// from list
+func (ts *tunnelSet) apply(list []config.Tunnel) {
+	ts.wg.Add(1)
+	defer ts.wg.Done()
+
+	ts.applyMu.Lock()
+	defer ts.applyMu.Unlock()
+
+	ts.Lock()
+	if ts.closing {
+		ts.Unlock()
+		return
+	}
+
+	keep := make(map[string]bool)
+	for _, t := range list {
+		keep[t.ListenKey()] = true
+	}
+
+	var removed []*tunnel
+	for key, tun := range ts.running {
+		if !keep[key] {
+			slog.Info("tunnel removed", "tunnel", tun.config.String())
+			delete(ts.running, key)
+			removed = append(removed, tun)
+		}
+	}
+	ts.Unlock()
+
+	// removed first, so a restarted tunnel can listen on the same address
+	for _, tun := range removed {
+		ts.drain(tun)
+	}
+
+	ts.Lock()
+	defer ts.Unlock()
+
+	if ts.closing {
+		return
+	}
+
+	for _, t := range list {
+		tun, ok := ts.running[t.ListenKey()]
+		if !ok {
+			ts.start(t)
+			continue
+		}
+
+		if reflect.DeepEqual(tun.config, t) {
+			continue
+		}
+
+		err := tun.reload(t)
+		if err != nil {
+			slog.Error("reload tunnel", "tunnel", t.String(), "error", err)
+			continue
+		}
+
+		tun.config = t
+		slog.Info("tunnel reloaded", "tunnel", t.String())
+	}
+}
+
+// start the client or server of t
+//
+// ts.Mutex must be held
+func (ts *tunnelSet) start(t config.Tunnel) {
+	key := t.ListenKey()
+	tun := &tunnel{config: t, stopped: make(chan struct{})}
+
+	var start func() error
+
+	if t.Mode == "server" {
+		opts, err := t.ServerOptions()
+		if err != nil {
+			slog.Error("parse allowlist", "tunnel", t.String(), "error", err)
+			return
+		}
+
+		s := server.NewServer(opts)
+		start = s.Start
+		tun.shutdown = s.Shutdown
+		tun.sessions = s
+		tun.reload = func(t config.Tunnel) error {
+			opts, err := t.ServerOptions()
+			if err != nil {
+				return err
+			}
+			return s.Reload(opts)
+		}
+	} else {
+		c := client.NewClient(t.ClientOptions())
+		start = c.Start
+		tun.shutdown = c.Shutdown
+		tun.reload = func(t config.Tunnel) error {
+			return c.Reload(t.ClientOptions())
+		}
+	}
+
+	ts.running[key] = tun
+	ts.wg.Add(1)
+
+	go func() {
+		defer ts.wg.Done()
+
+		slog.Info("commonweb2", "tunnel", t.String(), "mode", t.Mode)
+
+		err := start()
+		if errors.Is(err, net.ErrClosed) {
+			slog.Info("tunnel stops", "tunnel", t.String())
+		} else if err != nil {
+			slog.Error("tunnel stops", "tunnel", t.String(), "error", err)
+		}
+		close(tun.stopped)
+
+		// a tunnel which failed is started again by the next reload
+		ts.Lock()
+		if ts.running[key] == tun {
+			delete(ts.running, key)
+		}
+		ts.Unlock()
+	}()
+}
+
+// shut down tun in the background, and wait until it stops listening so
+// that another tunnel can listen on the same address
+//
+// it gives up after STOP_TIMEOUT, a tunnel which then fails to listen on the
+// address is started again by the next reload
+func (ts *tunnelSet) drain(tun *tunnel) {
+	ts.wg.Add(1)
+	go func() {
+		defer ts.wg.Done()
+
+		err := tun.shutdown(ts.draining)
+		if err != nil {
+			slog.Error("shut down removed tunnel", "tunnel", tun.config.String(), "error", err)
+		}
+	}()
+
+	select {
+	case <-tun.stopped:
+	case <-time.After(STOP_TIMEOUT):
+		slog.Warn("removed tunnel still listening", "tunnel", tun.config.String())
+	}
+}
+
+// shutdown stops every tunnel, the sessions of running and removed tunnels
+// may finish until ctx is done
+//
+// it returns once every tunnel has stopped
+func (ts *tunnelSet) shutdown(ctx context.Context) error {
+	ts.Lock()
+	ts.closing = true
+	running := ts.running
+	ts.running = make(map[string]*tunnel)
+	ts.Unlock()
+
+	stop := context.AfterFunc(ctx, ts.stopDraining)
+	defer stop()
+
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+
+	for _, tun := range running {
+		wg.Add(1)
+		go func(tun *tunnel) {
+			defer wg.Done()
+
+			err := tun.shutdown(ctx)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", tun.config.String(), err))
+				mu.Unlock()
+			}
+		}(tun)
+	}
+
+	wg.Wait()
+	ts.wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// the servers which are running, by tunnel name
+func (ts *tunnelSet) sources() map[string]admin.Source {
+	ts.Lock()
+	defer ts.Unlock()
+
+	sources := make(map[string]admin.Source)
+	for _, tun := range ts.running {
+		if tun.sessions != nil {
+			sources[tun.config.String()] = tun.sessions
+		}
+	}
+	return sources
+}
+
+// wait until every tunnel has stopped
+func (ts *tunnelSet) wait() {
+	ts.wg.Wait()
+}
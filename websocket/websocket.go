@@ -0,0 +1,318 @@
+// Package websocket carries a byte stream over a websocket connection
+// (RFC 6455).
+//
+// Each Write is sent as one binary message. Read returns the payload of data
+// messages in order, so message boundaries are not preserved. Ping and close
+// messages are answered by Read.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// the largest payload of a control frame
+const MAX_CONTROL_SIZE = 125
+
+// status code of the close message sent by Close
+const CLOSE_NORMAL = 1000
+
+// https://www.rfc-editor.org/rfc/rfc6455#section-1.3
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrProtocol = errors.New("websocket: protocol error")
+
+// NewKey returns a random Sec-WebSocket-Key
+func NewKey() string {
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic("rand: " + err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept of key
+func AcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// IsUpgrade reports whether the request headers ask for a websocket upgrade
+func IsUpgrade(headers textproto.MIMEHeader) bool {
+	if !strings.EqualFold(headers.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, v := range strings.Split(headers.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckUpgrade checks the headers of an upgrade request before the handshake
+func CheckUpgrade(headers textproto.MIMEHeader) error {
+	if headers.Get("Sec-WebSocket-Key") == "" {
+		return fmt.Errorf("%w: missing Sec-WebSocket-Key", ErrProtocol)
+	}
+	if headers.Get("Sec-WebSocket-Version") != "13" {
+		return fmt.Errorf("%w: unsupported version: %s", ErrProtocol, headers.Get("Sec-WebSocket-Version"))
+	}
+	return nil
+}
+
+// Accept finishes the handshake of an upgrade request read from r, whose
+// headers are given
+//
+// nothing is written if the request is invalid
+func Accept(conn net.Conn, r *bufio.Reader, headers textproto.MIMEHeader) (*Conn, error) {
+	err := CheckUpgrade(headers)
+	if err != nil {
+		return nil, err
+	}
+	key := headers.Get("Sec-WebSocket-Key")
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n"
+	resp += "Upgrade: websocket\r\n"
+	resp += "Connection: Upgrade\r\n"
+	resp += "Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n"
+	resp += "\r\n"
+	_, err = conn.Write([]byte(resp))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConn(conn, r, false), nil
+}
+
+// Conn is a websocket connection after the handshake
+type Conn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	client bool // frames sent by the client are masked
+
+	rmu       sync.Mutex
+	remaining uint64 // payload left in the current data frame
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// NewConn returns a websocket connection reading frames from r, which
+// buffers conn
+func NewConn(conn net.Conn, r *bufio.Reader, client bool) *Conn {
+	return &Conn{
+		conn:   conn,
+		r:      r,
+		client: client,
+	}
+}
+
+// write one frame
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return io.ErrClosedPipe
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode) // FIN
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if c.client {
+		var mask [4]byte
+		_, err := rand.Read(mask[:])
+		if err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// read the header of the next data frame, control frames are handled
+//
+// c.rmu must be held
+func (c *Conn) nextFrame() error {
+	for {
+		header := make([]byte, 2, 14)
+		_, err := io.ReadFull(c.r, header)
+		if err != nil {
+			return err
+		}
+
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7f)
+
+		if masked == c.client {
+			// clients must mask their frames, servers must not
+			return fmt.Errorf("%w: unexpected masking", ErrProtocol)
+		}
+
+		switch length {
+		case 126:
+			_, err = io.ReadFull(c.r, header[:2])
+			length = uint64(binary.BigEndian.Uint16(header[:2]))
+		case 127:
+			_, err = io.ReadFull(c.r, header[:8])
+			length = binary.BigEndian.Uint64(header[:8])
+		}
+		if err != nil {
+			return err
+		}
+
+		var mask [4]byte
+		if masked {
+			_, err = io.ReadFull(c.r, mask[:])
+			if err != nil {
+				return err
+			}
+		}
+
+		switch opcode {
+		case opContinuation, opText, opBinary:
+			c.remaining = length
+			c.masked = masked
+			c.mask = mask
+			c.maskPos = 0
+			return nil
+
+		case opClose, opPing, opPong:
+			if length > MAX_CONTROL_SIZE {
+				return fmt.Errorf("%w: control frame too large", ErrProtocol)
+			}
+
+			payload := make([]byte, length)
+			_, err = io.ReadFull(c.r, payload)
+			if err != nil {
+				return err
+			}
+			if masked {
+				for i := range payload {
+					payload[i] ^= mask[i%4]
+				}
+			}
+
+			if opcode == opClose {
+				// echo the status code and end the stream
+				c.writeFrame(opClose, payload[:min(len(payload), 2)])
+				return io.EOF
+			}
+			if opcode == opPing {
+				err = c.writeFrame(opPong, payload)
+				if err != nil {
+					return err
+				}
+			}
+
+		default:
+			return fmt.Errorf("%w: unknown opcode: %d", ErrProtocol, opcode)
+		}
+	}
+}
+
+// Read reads the payload of data messages, it returns io.EOF once a close
+// message is received
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for c.remaining == 0 {
+		err := c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.r.Read(p[:min(uint64(len(p)), c.remaining)])
+	c.remaining -= uint64(n)
+
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Write sends p as one binary message
+func (c *Conn) Write(p []byte) (int, error) {
+	err := c.writeFrame(opBinary, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite sends a close message, the peer is expected to answer with a
+// close message
+func (c *Conn) CloseWrite() error {
+	return c.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, CLOSE_NORMAL))
+}
+
+// Close sends a close message if none was sent, and closes the connection
+func (c *Conn) Close() error {
+	c.CloseWrite()
+	return c.conn.Close()
+}